@@ -1,43 +1,133 @@
 package main
 
 import (
+	"flag"
 	"github.com/pfandl/dws/backingstore"
+	"github.com/pfandl/dws/bridge"
 	"github.com/pfandl/dws/config"
 	"github.com/pfandl/dws/data"
 	"github.com/pfandl/dws/debug"
 	"github.com/pfandl/dws/event"
+	"github.com/pfandl/dws/gateway"
 	"github.com/pfandl/dws/module"
 	"github.com/pfandl/dws/network"
+	"github.com/pfandl/dws/plugin"
 	"github.com/pfandl/dws/server"
 	"os"
 	"os/signal"
+	"reflect"
+	"strings"
+	"syscall"
 )
 
+// commands changing the runtime state, they are journaled
+// once the config module accepted them
+var journaled = map[string]bool{
+	"add-server":          true,
+	"update-server":       true,
+	"remove-server":       true,
+	"add-network":         true,
+	"update-network":      true,
+	"remove-network":      true,
+	"add-host":            true,
+	"update-host":         true,
+	"remove-host":         true,
+	"add-backingstore":    true,
+	"update-backingstore": true,
+	"remove-backingstore": true,
+}
+
+// parents names the field of a resource naming the resource it
+// belongs to, removing that one removes it as well
+var parents = map[string]string{
+	"network": "Server",
+	"host":    "Network",
+}
+
+// journalKey returns the key of the journal record of the command m,
+// e.g. "server/main", the key of the resource it belongs to and whether
+// m removes what the key stands for. Updates get keys of their own so
+// they do not supersede the addition.
+func journalKey(m *data.Message) (string, string, bool) {
+	op, kind, _ := strings.Cut(m.Message, "-")
+	name, ok := m.Data.(string)
+	parent := ""
+	if ok == false {
+		// additions and updates carry the whole resource
+		if v := reflect.ValueOf(m.Data); v.Kind() == reflect.Struct {
+			if f := v.FieldByName("Name"); f.Kind() == reflect.String {
+				name = f.String()
+			}
+			if p, ok := parents[kind]; ok == true {
+				if f := v.FieldByName(p); f.Kind() == reflect.String && f.String() != "" {
+					parent = strings.ToLower(p) + "/" + f.String()
+				}
+			}
+		}
+	}
+	if name == "" {
+		return "", "", false
+	}
+	k := kind + "/" + name
+	switch op {
+	case "update":
+		return k + "/update", parent, false
+	case "remove":
+		return k, parent, true
+	}
+	return k, parent, false
+}
+
 func main() {
+	path := flag.String("journal", "", "journal file, runtime changes are not kept if empty")
+	flag.Parse()
+
 	debug.SetLevel(debug.All)
 	debug.OnFatal(func() {
 		module.StopAll()
 	})
+	if *path != "" {
+		j, e := event.OpenJournal(*path)
+		if e != nil {
+			debug.Fat("cannot open journal %s: %s", *path, e.Error())
+		}
+		// closed by StopAll, also if we die
+		j.Select("check-command", "command", func(v interface{}) (string, string, bool, bool) {
+			m := v.(*data.Message)
+			if journaled[m.Message] == false {
+				return "", "", false, false
+			}
+			k, parent, removes := journalKey(m)
+			return k, parent, removes, true
+		})
+		module.SetJournal(j)
+	}
 	module.Register(&config.Config{})
-	module.Register(&backingstore.BackingStore{})
+	module.Register(&backingstore.BackingStore{}, module.Optional)
 	module.Register(&server.Server{})
-	module.Register(&network.Network{})
+	module.Register(&network.Network{}, module.Optional)
+	module.Register(&plugin.Plugins{}, module.Optional)
+	module.Register(&bridge.Bridges{}, module.Optional)
+	module.Register(&gateway.Gateways{}, module.Optional)
 	if err := module.StartAll(); err != nil {
 		debug.Fat(err.Error())
 	}
-	if err := module.GetError("config"); err != nil {
-		debug.Fat(err.Error())
+	for _, s := range module.GetStatus() {
+		debug.Info("module %s is %s", s.Name, s.State)
+		if s.State != module.Failed {
+			continue
+		}
+		// the supervisor takes care of modules that may be restarted
+		m, _ := module.Get(s.Name)
+		if s.Optional == false && module.PolicyOf(m).Restart == module.Never {
+			debug.Fat("module %s failed: %s", s.Name, s.Error)
+		}
+		debug.Warn("module %s failed: %s", s.Name, s.Error)
 	}
-	if err := module.GetError("backingstore"); err != nil {
-		debug.Fat(err.Error())
+	if module.Mode() == module.Degraded {
+		debug.Warn("running in degraded mode")
 	}
-	if err := module.GetError("server"); err != nil {
-		debug.Fat(err.Error())
-	}
-	if err := module.GetError("network"); err != nil {
-		debug.Fat(err.Error())
-	}
-	event.Fire("command", &data.Message{Message: "get-backingstore-path"})
+	module.Supervise()
 
 	// test adding server
 	event.Fire(
@@ -93,12 +183,18 @@ func main() {
 	// we are done loading, we now can just wait until we
 	// get killed or gracefully stopped via system signals
 
-	// set up signal interrupting, notifies on all signals
+	// set up signal interrupting, SIGUSR1 dumps the event trace
 	c := make(chan os.Signal, 1)
-	signal.Notify(c)
+	signal.Notify(c, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP, syscall.SIGQUIT, syscall.SIGUSR1)
 
-	// Block until a signal is received.
-	_ = <-c
+	// Block until a stopping signal is received.
+	for s := range c {
+		if s == syscall.SIGUSR1 {
+			event.Dump()
+			continue
+		}
+		break
+	}
 
 	debug.Info("signal received, stopping")
 
@@ -1,6 +1,9 @@
 package backingstore
 
 import (
+	"crypto/tls"
+	"errors"
+	"github.com/pfandl/dws/communication"
 	"github.com/pfandl/dws/config"
 	"github.com/pfandl/dws/data"
 	"github.com/pfandl/dws/debug"
@@ -9,36 +12,50 @@ import (
 	"github.com/pfandl/dws/module"
 	"io"
 	"net"
+	"reflect"
+	"sync"
 	"time"
 )
 
 var (
 	// events we fire
 	ActiveEvents = []string{
-		"get-backingstore-path",
 		"command-result",
 	}
 	// events we are interested in
 	PassiveEvents = []string{
 		"backingstore-available",
-		"command",
 		"check-command",
 	}
+	// payloads of the events we fire
+	EventTypes = map[string]reflect.Type{
+		"command-result": reflect.TypeOf(&data.Message{}),
+	}
+	// for dialing the remote backing store
+	Timeout = 10 * time.Second
 	// errors
 	BackingStorInvalid = "could not convert backing store"
 	// messages
 	BackingStoreAdded = "backingstore was added"
-	// communication channel
-	Channel chan *data.Message
+	// communication channel, shared by all threads
+	Channel = make(chan *data.Message)
 )
 
 type Thread struct {
 	Running bool
 	Server  interface{}
+	// guards everything below
+	lock sync.Mutex
+	// closed by Stop
+	listener net.Listener
+	// closed by Stop to end the talker
+	done chan bool
 }
 
 type BackingStore struct {
 	module.Module
+	// guards everything below
+	lock    sync.Mutex
 	Servers []*Thread
 }
 
@@ -46,6 +63,10 @@ func (c *BackingStore) Name() string {
 	return "backingstore"
 }
 
+func (c *BackingStore) Dependencies() []string {
+	return []string{"config"}
+}
+
 func (c *BackingStore) Events(active bool) []string {
 	debug.Ver("BackingStore: Events %v", active)
 	if active == true {
@@ -55,17 +76,29 @@ func (c *BackingStore) Events(active bool) []string {
 	}
 }
 
+func (c *BackingStore) EventTypes() map[string]reflect.Type {
+	return EventTypes
+}
+
 func (c *BackingStore) Event(e string, v interface{}) {
 	debug.Ver("BackingStore got event: %s %v", e, v)
 	switch e {
 	case "backingstore-available":
 		c.Available(v)
-	case "command":
-		c.Command(v.(*data.Message))
 	case "check-command":
 		c.CheckCommand(v.(*data.Message))
 	default:
-		debug.Fat("BackingStore event %s unknown", e)
+		debug.Err("BackingStore event %s unknown", e)
+	}
+}
+
+func (c *BackingStore) RestartPolicy() module.Policy {
+	// the remote backing store might just not be reachable yet
+	return module.Policy{
+		Restart:    module.OnFailure,
+		MaxRetries: 10,
+		Backoff:    2 * time.Second,
+		MaxBackoff: 2 * time.Minute,
 	}
 }
 
@@ -76,126 +109,172 @@ func (c *BackingStore) Init() error {
 
 func (c *BackingStore) Start() error {
 	debug.Ver("BackingStore Start()")
+	c.lock.Lock()
+	defer c.lock.Unlock()
 	for _, s := range c.Servers {
 		if err := s.Start(); err != nil {
+			c.stop()
 			return err
 		}
 	}
 	return nil
 }
 
+// Start listens or talks to the backing store, it does
+// nothing if the thread is running already.
 func (c *Thread) Start() error {
 	debug.Ver("Thread Start()")
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.listener != nil || c.done != nil {
+		return nil
+	}
 	if bs, ok := c.Server.(*config.LocalBackingStore); ok {
-		if l, err := net.Listen("tcp", ":"+bs.Host.IpV4.Port); err != nil {
+		// with a certificate authority only known servers get in
+		t, err := bs.Host.Tls.ListenConfig()
+		if err != nil {
+			return err
+		}
+		if l, err := communication.Listen(":"+bs.Host.IpV4.Port, t); err != nil {
 			return err
 		} else {
+			c.listener = l
+			c.Running = true
 			// run in thread
 			go c.RunListener(l)
 		}
 	} else {
-		if _, ok := c.Server.(*config.RemoteBackingStore); ok {
-			go c.RunTalker()
+		if bs, ok := c.Server.(*config.RemoteBackingStore); ok {
+			t, err := bs.Host.Tls.DialConfig(bs.Host.IpV4.Address)
+			if err != nil {
+				return err
+			}
+			c.done = make(chan bool)
+			c.Running = true
+			go c.RunTalker(t, c.done)
 			return nil
 		} else {
 			return err.New(BackingStorInvalid)
 		}
 	}
 
-	Channel = make(chan *data.Message)
-
 	return nil
 }
 
+// Stop closes the listener or ends the talker of the thread.
+func (c *Thread) Stop() {
+	debug.Ver("Thread Stop()")
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.listener != nil {
+		c.listener.Close()
+		c.listener = nil
+	}
+	if c.done != nil {
+		close(c.done)
+		c.done = nil
+	}
+	c.Running = false
+}
+
 func (c *Thread) RunListener(l net.Listener) {
 	debug.Ver("BackingStore RunListener Run()")
 
-	c.Running = true
-	for c.Running {
+	for {
 		debug.Ver("BackingStore RunListener Waiting...")
 		c, err := l.Accept()
-		if err != nil {
+		if errors.Is(err, net.ErrClosed) == true {
+			return
+		} else if err != nil {
 			debug.Err("BackingStore RunListener connection failed %s", err.Error())
 			continue
 		}
 
 		go func(c net.Conn) {
-			debug.Ver("BackingStore RunListener connection established with %s", c.LocalAddr().String())
+			debug.Ver("BackingStore RunListener connection established with %s", c.RemoteAddr().String())
 
+			f := communication.NewFramer(c)
 			// close when returning
-			defer func() { c.Close() }()
-
-			var msg string
-			// should be enough for most messages
-			b := make([]byte, 2048)
+			defer func() { f.Close() }()
 
+			// the connection is kept until the talker closes it
 			for {
-				// we are looping to get all data
-				s, err := c.Read(b)
-				if err != nil && err != io.EOF {
-					debug.Warn("BackingStore RunListener listener read failed %s", err.Error())
-					c.Close()
-					return
-				} else {
-					// EOF is a welcomed error
-					if s <= 0 {
-						// stop reading if EOF and no data left to read
-						break
+				msg, err := f.ReadFrame()
+				if err != nil {
+					if err != io.EOF {
+						debug.Warn("BackingStore RunListener listener read failed %s", err.Error())
 					}
-					// add part of message
-					msg += string(b[0:s])
+					return
 				}
-			}
-
-			// did we receive anything?
-			if msg != "" {
-				debug.Ver(msg)
+				debug.Ver(string(msg))
 			}
 		}(c)
 	}
 }
 
-func (c *Thread) RunTalker() {
+// RunTalker sends the messages of Channel to the remote backing
+// store until done is closed.
+func (c *Thread) RunTalker(t *tls.Config, done chan bool) {
 	debug.Ver("RemoteBackingStore Thread RunTalker")
 
 	bs := (c.Server).(*config.RemoteBackingStore)
 
-	c.Running = true
-
-	for c.Running {
+	// the connection is reused until it breaks
+	var f *communication.Framer
+	defer func() {
+		if f != nil {
+			f.Close()
+		}
+	}()
 
+	for {
+		var m *data.Message
 		// wait till we need to send data
-		m := <-Channel
-
-		if l, err := net.Dial("tcp", bs.Host.IpV4.Address+":"+bs.Host.IpV4.Port); err != nil {
-			debug.Err(err.Error())
-			time.Sleep(10 * time.Second)
-			continue
-		} else {
-			debug.Ver("RemoteBackingStore RunTalker connection established with %s", l.RemoteAddr().String())
+		select {
+		case m = <-Channel:
+		case <-done:
+			return
+		}
 
-			_, err := l.Write([]byte(m.ToJson()))
+		if f == nil {
+			l, err := communication.Dial(bs.Host.IpV4.Address+":"+bs.Host.IpV4.Port, t, Timeout)
 			if err != nil {
-				debug.Err("RemoteBackingStore RunTalker connection failed %s", err.Error())
+				debug.Err(err.Error())
+				// nobody else answers m
+				m.Succeeded = false
+				m.Message = err.Error()
+				event.Fire("command-result", m)
 				continue
 			}
-			l.Close()
+			debug.Ver("RemoteBackingStore RunTalker connection established with %s", l.RemoteAddr().String())
+			f = communication.NewFramer(l)
+		}
+
+		if _, err := f.WriteFrame([]byte(m.ToJson())); err != nil {
+			debug.Err("RemoteBackingStore RunTalker connection failed %s", err.Error())
+			f.Close()
+			f = nil
 		}
 	}
 }
 
 func (c *BackingStore) Stop() error {
 	debug.Ver("BackingStore Stop()")
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.stop()
 	return nil
 }
 
-func (c *BackingStore) CheckCommand(m *data.Message) {
-	debug.Ver("BackingStore CheckCommand: %v", m)
+// stop stops all threads, must be called with the lock held.
+func (c *BackingStore) stop() {
+	for _, s := range c.Servers {
+		s.Stop()
+	}
 }
 
-func (c *BackingStore) Command(m *data.Message) {
-	debug.Ver("BackingStore Command: %v", m)
-	Channel <- m
+func (c *BackingStore) CheckCommand(m *data.Message) {
+	debug.Ver("BackingStore CheckCommand: %v", m)
 }
 
 func (c *BackingStore) CreateThread(s interface{}) (*Thread, error) {
@@ -209,6 +288,8 @@ func (c *BackingStore) CreateThread(s interface{}) (*Thread, error) {
 
 func (c *BackingStore) Add(s interface{}, t *Thread) {
 	debug.Ver("BackingStore Add: %v", s)
+	c.lock.Lock()
+	defer c.lock.Unlock()
 	if t == nil {
 		t = &Thread{
 			Server:  s,
@@ -0,0 +1,85 @@
+package backingstore
+
+import (
+	"github.com/pfandl/dws/config"
+	"net"
+	"testing"
+)
+
+// port returns a port nobody listens on.
+func port(t *testing.T) string {
+	l, e := net.Listen("tcp", ":0")
+	if e != nil {
+		t.Fatal(e)
+	}
+	defer l.Close()
+	_, p, _ := net.SplitHostPort(l.Addr().String())
+	return p
+}
+
+func TestRestart(t *testing.T) {
+	s := &config.LocalBackingStore{Name: "test"}
+	s.Host.IpV4.Port = port(t)
+	c := &BackingStore{}
+	c.Add(s, nil)
+
+	tests := []struct {
+		name      string
+		f         func() error
+		listening bool
+	}{
+		{"started", c.Start, true},
+		{"started again", c.Start, true},
+		{"stopped", c.Stop, false},
+		{"stopped again", c.Stop, false},
+		{"restarted", c.Start, true},
+	}
+	for _, tt := range tests {
+		if e := tt.f(); e != nil {
+			t.Fatalf("%s: %v", tt.name, e)
+		}
+		conn, e := net.Dial("tcp", "127.0.0.1:"+s.Host.IpV4.Port)
+		if e == nil {
+			conn.Close()
+		}
+		if (e == nil) != tt.listening {
+			t.Errorf("%s: listening %v, want %v", tt.name, e == nil, tt.listening)
+		}
+	}
+	c.Stop()
+}
+
+func TestStopTalker(t *testing.T) {
+	s := &config.RemoteBackingStore{}
+	s.Host.IpV4.Address = "127.0.0.1"
+	s.Host.IpV4.Port = port(t)
+	c := &BackingStore{}
+	c.Add(s, nil)
+	th := c.Servers[0]
+	var done chan bool
+	for i := 0; i < 3; i++ {
+		if e := c.Start(); e != nil {
+			t.Fatal(e)
+		}
+		th.lock.Lock()
+		if done == nil {
+			done = th.done
+		}
+		// started once, a single talker reads the channel
+		if th.done != done {
+			t.Errorf("start %d: started another talker", i)
+		}
+		th.lock.Unlock()
+	}
+	if e := c.Stop(); e != nil {
+		t.Fatal(e)
+	}
+	select {
+	case <-done:
+	default:
+		t.Fatal("talker was not stopped")
+	}
+	if th.Running == true {
+		t.Error("stopped talker is still running")
+	}
+}
@@ -0,0 +1,92 @@
+// Command benchmark measures event throughput under many
+// concurrent Fire calls.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"github.com/pfandl/dws/event"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	Modes = map[string]event.Mode{
+		"parallel":    event.Parallel,
+		"synchronous": event.Synchronous,
+		"ordered":     event.Ordered,
+	}
+	Policies = map[string]event.Policy{
+		"block":       event.Block,
+		"drop-newest": event.DropNewest,
+		"drop-oldest": event.DropOldest,
+	}
+)
+
+func main() {
+	fires := flag.Int("fires", 1000, "fire calls per goroutine")
+	goroutines := flag.Int("goroutines", 1000, "goroutines firing concurrently")
+	subscribers := flag.Int("subscribers", 4, "callbacks registered for the event")
+	mode := flag.String("mode", "parallel", "parallel, synchronous or ordered")
+	workers := flag.Int("workers", event.DefaultOptions.Workers, "workers delivering the event")
+	queue := flag.Int("queue", event.DefaultOptions.Queue, "queue depth")
+	policy := flag.String("policy", "block", "block, drop-newest or drop-oldest")
+	work := flag.Duration("work", 0, "time spent in every callback")
+	flag.Parse()
+
+	m, ok := Modes[*mode]
+	if ok == false {
+		fmt.Fprintf(os.Stderr, "unknown mode %s\n", *mode)
+		os.Exit(1)
+	}
+	p, ok := Policies[*policy]
+	if ok == false {
+		fmt.Fprintf(os.Stderr, "unknown policy %s\n", *policy)
+		os.Exit(1)
+	}
+	if e := event.Configure("benchmark", event.Options{
+		Mode:    m,
+		Workers: *workers,
+		Queue:   *queue,
+		Policy:  p,
+	}); e != nil {
+		fmt.Fprintln(os.Stderr, e.Error())
+		os.Exit(1)
+	}
+	a, _ := event.RegisterEvent("benchmark")
+
+	var delivered atomic.Uint64
+	for i := 0; i < *subscribers; i++ {
+		event.RegisterCallback("benchmark", func(string, interface{}) {
+			if *work > 0 {
+				time.Sleep(*work)
+			}
+			delivered.Add(1)
+		})
+	}
+
+	var wg sync.WaitGroup
+	start := time.Now()
+	for i := 0; i < *goroutines; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < *fires; j++ {
+				event.Fire("benchmark", j)
+			}
+		}()
+	}
+	wg.Wait()
+	fired := time.Since(start)
+	event.Flush()
+	done := time.Since(start)
+
+	total := *goroutines * *fires
+	fmt.Printf("fired      %d events from %d goroutines in %v (%.0f fires/s)\n",
+		total, *goroutines, fired, float64(total)/fired.Seconds())
+	fmt.Printf("delivered  %d of %d in %v (%.0f deliveries/s)\n",
+		delivered.Load(), total**subscribers, done, float64(delivered.Load())/done.Seconds())
+	fmt.Printf("dropped    %d\n", a.Dropped())
+}
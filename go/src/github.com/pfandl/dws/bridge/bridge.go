@@ -0,0 +1,445 @@
+// Package bridge forwards events between dws nodes. Both ends of a
+// bridge write one Message as JSON per line. Every forwarded event is
+// kept until the other node acknowledged it and is sent again after a
+// reconnect, the receiving node drops events it already fired.
+package bridge
+
+import (
+	"bufio"
+	"crypto/tls"
+	"encoding/json"
+	"github.com/pfandl/dws/communication"
+	"github.com/pfandl/dws/config"
+	"github.com/pfandl/dws/data"
+	"github.com/pfandl/dws/debug"
+	"github.com/pfandl/dws/error"
+	"github.com/pfandl/dws/event"
+	"github.com/pfandl/dws/module"
+	"net"
+	"path"
+	"sync"
+	"time"
+)
+
+var (
+	// events we fire
+	ActiveEvents = []string{}
+	// events we are interested in
+	PassiveEvents = []string{
+		"bridge-available",
+	}
+	// for dialing and writing
+	Timeout = 10 * time.Second
+	// waiting time between connection attempts
+	Backoff    = time.Second
+	MaxBackoff = time.Minute
+	// unacknowledged events kept per bridge
+	MaxPending = 1024
+	// peer nodes remembered per bridge, a peer is a new node
+	// every time it restarts
+	MaxSeen = 16
+	// longest line a peer may write
+	MaxLineSize = 1024 * 1024
+	// errors
+	BridgeNotConnected = "bridge is not connected"
+)
+
+// Message is a single line on a bridge connection.
+type Message struct {
+	// "event" or "ack"
+	Type string
+	// sending node and its sequence number of the event
+	Node  string `json:",omitempty"`
+	Seq   uint64
+	Event string          `json:",omitempty"`
+	Value json.RawMessage `json:",omitempty"`
+}
+
+// Bridges is the module forwarding events over all configured bridges.
+type Bridges struct {
+	module.Module
+	// guards everything below, events are forwarded while
+	// bridges are started and stopped
+	lock    sync.Mutex
+	Configs []*config.Bridge
+	Bridges []*Bridge
+	// sees every event, forwards those of interest
+	forwarder *event.Subscription
+}
+
+func (c *Bridges) Name() string {
+	return "bridge"
+}
+
+func (c *Bridges) Dependencies() []string {
+	return []string{"config"}
+}
+
+func (c *Bridges) Events(active bool) []string {
+	debug.Ver("Bridges: Events %v", active)
+	if active == true {
+		return ActiveEvents
+	} else {
+		return PassiveEvents
+	}
+}
+
+func (c *Bridges) Event(e string, v interface{}) {
+	debug.Ver("Bridges got event: %s %v", e, v)
+	switch e {
+	case "bridge-available":
+		c.Available(v.(*config.Bridge))
+	default:
+		debug.Err("Bridges event %s unknown", e)
+	}
+}
+
+func (c *Bridges) Init() error {
+	debug.Ver("Bridges Init()")
+	return nil
+}
+
+func (c *Bridges) Start() error {
+	debug.Ver("Bridges Start()")
+	c.lock.Lock()
+	configs := append([]*config.Bridge{}, c.Configs...)
+	c.lock.Unlock()
+	s, e := event.SubscribePattern("*", c.forward)
+	if e != nil {
+		return e
+	}
+	// not locked while starting, starting might fire events
+	var bridges []*Bridge
+	for _, cfg := range configs {
+		b := New(cfg)
+		b.forwarder = s
+		// received events must be known even if no module here fires them
+		for _, e := range cfg.Events {
+			if event.IsPattern(e) == false {
+				event.RegisterEvent(e)
+			}
+		}
+		if e := b.Start(); e != nil {
+			s.Cancel()
+			for _, b := range bridges {
+				b.Stop()
+			}
+			return e
+		}
+		bridges = append(bridges, b)
+	}
+	c.lock.Lock()
+	c.forwarder = s
+	c.Bridges = bridges
+	c.lock.Unlock()
+	return nil
+}
+
+func (c *Bridges) stop() {
+	c.lock.Lock()
+	s, bridges := c.forwarder, c.Bridges
+	c.forwarder = nil
+	c.Bridges = nil
+	c.lock.Unlock()
+	if s != nil {
+		s.Cancel()
+	}
+	for _, b := range bridges {
+		b.Stop()
+	}
+}
+
+func (c *Bridges) Stop() error {
+	debug.Ver("Bridges Stop()")
+	c.stop()
+	return nil
+}
+
+func (c *Bridges) Available(b *config.Bridge) {
+	debug.Ver("Bridges available: %v", b)
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.Configs = append(c.Configs, b)
+}
+
+func (c *Bridges) forward(s string, v interface{}) {
+	c.lock.Lock()
+	bridges := c.Bridges
+	c.lock.Unlock()
+	for _, b := range bridges {
+		if b.Bridged(s) == true {
+			b.Send(s, v)
+		}
+	}
+}
+
+// Bridge is the connection to a single other node.
+type Bridge struct {
+	Config *config.Bridge
+	// received events are not handed to this subscription
+	forwarder *event.Subscription
+	// identifies this end of the bridge to the peer, a new one
+	// starts a new sequence
+	node string
+	// guards everything below
+	lock     sync.Mutex
+	listener net.Listener
+	conn     net.Conn
+	seq      uint64
+	pending  []*Message
+	// highest sequence number fired per sending node
+	seen map[string]uint64
+	// nodes of seen, least recently fired first
+	nodes   []string
+	stopped bool
+}
+
+func New(c *config.Bridge) *Bridge {
+	return &Bridge{
+		Config: c,
+		node:   event.NewId(),
+		seen:   make(map[string]uint64),
+	}
+}
+
+// Bridged reports whether the event s is forwarded over b.
+func (b *Bridge) Bridged(s string) bool {
+	for _, e := range b.Config.Events {
+		if e == s {
+			return true
+		}
+		if ok, _ := path.Match(e, s); event.IsPattern(e) == true && ok == true {
+			return true
+		}
+	}
+	return false
+}
+
+// Start connects to the peer or listens for it.
+func (b *Bridge) Start() error {
+	debug.Ver("Bridge %s Start()", b.Config.Name)
+	ip := b.Config.IpV4
+	if ip.Address != "" {
+		t, e := b.Config.Tls.DialConfig(ip.Address)
+		if e != nil {
+			return e
+		}
+		go b.dial(ip.Address+":"+ip.Port, t)
+		return nil
+	}
+	t, e := b.Config.Tls.ListenConfig()
+	if e != nil {
+		return e
+	}
+	l, e := communication.Listen(":"+ip.Port, t)
+	if e != nil {
+		return e
+	}
+	b.lock.Lock()
+	b.listener = l
+	b.lock.Unlock()
+	go b.accept(l)
+	return nil
+}
+
+func (b *Bridge) Stop() {
+	debug.Ver("Bridge %s Stop()", b.Config.Name)
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.stopped = true
+	if b.listener != nil {
+		b.listener.Close()
+	}
+	if b.conn != nil {
+		b.conn.Close()
+	}
+}
+
+func (b *Bridge) isStopped() bool {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return b.stopped
+}
+
+func (b *Bridge) dial(addr string, t *tls.Config) {
+	wait := Backoff
+	for b.isStopped() == false {
+		conn, e := communication.Dial(addr, t, Timeout)
+		if e != nil {
+			debug.Warn("Bridge %s cannot connect to %s (%s)", b.Config.Name, addr, e.Error())
+			time.Sleep(wait)
+			if wait *= 2; wait > MaxBackoff {
+				wait = MaxBackoff
+			}
+			continue
+		}
+		wait = Backoff
+		b.serve(conn)
+	}
+}
+
+func (b *Bridge) accept(l net.Listener) {
+	for {
+		conn, e := l.Accept()
+		if e != nil {
+			if b.isStopped() == true {
+				return
+			}
+			debug.Err("Bridge %s accept failed %s", b.Config.Name, e.Error())
+			time.Sleep(Backoff)
+			continue
+		}
+		go b.serve(conn)
+	}
+}
+
+// serve makes conn the connection of b, resends all pending
+// events and handles what the peer sends until conn breaks.
+func (b *Bridge) serve(conn net.Conn) {
+	debug.Info("Bridge %s connected with %s", b.Config.Name, conn.RemoteAddr().String())
+	b.lock.Lock()
+	if b.stopped == true {
+		b.lock.Unlock()
+		conn.Close()
+		return
+	}
+	if b.conn != nil {
+		// the peer reconnected
+		b.conn.Close()
+	}
+	b.conn = conn
+	for _, m := range b.pending {
+		if e := b.write(m); e != nil {
+			break
+		}
+	}
+	b.lock.Unlock()
+
+	r := bufio.NewScanner(conn)
+	r.Buffer(make([]byte, 4096), MaxLineSize)
+	for r.Scan() {
+		m := &Message{}
+		if e := json.Unmarshal(r.Bytes(), m); e != nil {
+			debug.Warn("Bridge %s got invalid message (%s)", b.Config.Name, e.Error())
+			continue
+		}
+		switch m.Type {
+		case "event":
+			b.receive(m)
+		case "ack":
+			b.acknowledged(m.Seq)
+		}
+	}
+	if e := r.Err(); e != nil {
+		debug.Warn("Bridge %s connection failed %s", b.Config.Name, e.Error())
+	}
+	debug.Info("Bridge %s disconnected from %s", b.Config.Name, conn.RemoteAddr().String())
+	b.lock.Lock()
+	if b.conn == conn {
+		b.conn = nil
+	}
+	b.lock.Unlock()
+	conn.Close()
+}
+
+// write sends m over the current connection, must be called with
+// the lock held. A broken connection is closed, serve notices.
+func (b *Bridge) write(m *Message) error {
+	if b.conn == nil {
+		return err.New(BridgeNotConnected, b.Config.Name)
+	}
+	d, e := json.Marshal(m)
+	if e != nil {
+		return e
+	}
+	b.conn.SetWriteDeadline(time.Now().Add(Timeout))
+	if _, e := b.conn.Write(append(d, '\n')); e != nil {
+		debug.Warn("Bridge %s write failed %s", b.Config.Name, e.Error())
+		b.conn.Close()
+		return e
+	}
+	return nil
+}
+
+// Send forwards the event s with payload v to the peer, unless
+// it must not leave the caller, like a new token.
+func (b *Bridge) Send(s string, v interface{}) {
+	if data.IsPrivate(v) == true {
+		return
+	}
+	d, e := json.Marshal(v)
+	if e != nil {
+		debug.Err("Bridge %s cannot forward %s (%s)", b.Config.Name, s, e.Error())
+		return
+	}
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if b.stopped == true {
+		return
+	}
+	b.seq++
+	m := &Message{Type: "event", Node: b.node, Seq: b.seq, Event: s, Value: d}
+	if len(b.pending) >= MaxPending {
+		debug.Warn("Bridge %s dropping unacknowledged %s", b.Config.Name, b.pending[0].Event)
+		b.pending[0] = nil
+		b.pending = b.pending[1:]
+	}
+	b.pending = append(b.pending, m)
+	if b.conn != nil {
+		b.write(m)
+	}
+}
+
+func (b *Bridge) acknowledged(seq uint64) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	i := 0
+	for i < len(b.pending) && b.pending[i].Seq <= seq {
+		b.pending[i] = nil
+		i++
+	}
+	b.pending = b.pending[i:]
+}
+
+// receive fires an event of the peer unless it was fired already.
+func (b *Bridge) receive(m *Message) {
+	defer func() {
+		b.lock.Lock()
+		b.write(&Message{Type: "ack", Seq: m.Seq})
+		b.lock.Unlock()
+	}()
+	b.lock.Lock()
+	seen := b.seen[m.Node]
+	b.lock.Unlock()
+	if m.Seq <= seen {
+		debug.Ver("Bridge %s dropping duplicate %s %d", b.Config.Name, m.Event, m.Seq)
+		return
+	}
+	if b.Bridged(m.Event) == false {
+		debug.Warn("Bridge %s dropping %s, it is not bridged", b.Config.Name, m.Event)
+	} else if v, e := event.Decode(m.Event, m.Value); e != nil {
+		debug.Warn("Bridge %s got invalid %s (%s)", b.Config.Name, m.Event, e.Error())
+	} else if e := event.FireExcept(m.Event, v, b.forwarder); e != nil {
+		debug.Warn("Bridge %s cannot fire %s (%s)", b.Config.Name, m.Event, e.Error())
+	}
+	b.lock.Lock()
+	b.see(m.Node, m.Seq)
+	b.lock.Unlock()
+}
+
+// see records seq as fired for node and forgets about the node
+// fired least recently if there are too many.
+func (b *Bridge) see(node string, seq uint64) {
+	for i, n := range b.nodes {
+		if n == node {
+			b.nodes = append(b.nodes[:i:i], b.nodes[i+1:]...)
+			break
+		}
+	}
+	b.nodes = append(b.nodes, node)
+	b.seen[node] = seq
+	if len(b.nodes) > MaxSeen {
+		delete(b.seen, b.nodes[0])
+		b.nodes = b.nodes[1:]
+	}
+}
@@ -0,0 +1,107 @@
+package bridge
+
+import (
+	"github.com/pfandl/dws/config"
+	"github.com/pfandl/dws/data"
+	"github.com/pfandl/dws/event"
+	"runtime"
+	"testing"
+	"time"
+)
+
+func TestSend(t *testing.T) {
+	tests := []struct {
+		name    string
+		v       interface{}
+		pending int
+	}{
+		{"message", &data.Message{Message: "add-server"}, 1},
+		{"private", &data.Message{Message: "create-token", Private: true}, 0},
+		{"other", "main", 1},
+	}
+	for _, tt := range tests {
+		b := New(&config.Bridge{Name: "test", Events: []string{"command-result"}})
+		b.Send("command-result", tt.v)
+		if len(b.pending) != tt.pending {
+			t.Errorf("%s: %d pending, want %d", tt.name, len(b.pending), tt.pending)
+		}
+	}
+}
+
+func TestSeen(t *testing.T) {
+	old := MaxSeen
+	MaxSeen = 2
+	defer func() {
+		MaxSeen = old
+	}()
+	b := New(&config.Bridge{Name: "test"})
+	tests := []struct {
+		node string
+		seq  uint64
+		// nodes remembered afterwards
+		want []string
+	}{
+		{"a", 1, []string{"a"}},
+		{"b", 1, []string{"a", "b"}},
+		{"a", 2, []string{"b", "a"}},
+		{"c", 1, []string{"a", "c"}},
+		{"d", 1, []string{"c", "d"}},
+	}
+	for i, tt := range tests {
+		b.see(tt.node, tt.seq)
+		if len(b.seen) != len(tt.want) || len(b.nodes) != len(tt.want) {
+			t.Fatalf("%d: seen %v, want %v", i, b.seen, tt.want)
+		}
+		if b.seen[tt.node] != tt.seq {
+			t.Errorf("%d: got seq %d for %s, want %d", i, b.seen[tt.node], tt.node, tt.seq)
+		}
+		for j, n := range tt.want {
+			if b.nodes[j] != n {
+				t.Errorf("%d: nodes %v, want %v", i, b.nodes, tt.want)
+			}
+			if _, ok := b.seen[n]; ok == false {
+				t.Errorf("%d: %s forgotten", i, n)
+			}
+		}
+	}
+}
+
+func TestForwardWhileStarting(t *testing.T) {
+	if _, e := event.RegisterEvent("test-bridged"); e != nil {
+		t.Fatal(e)
+	}
+	defer event.UnRegisterEvent("test-bridged")
+	c := &Bridges{}
+	for i := 0; i < 4; i++ {
+		cfg := &config.Bridge{Name: "test", Events: []string{"test-*"}}
+		cfg.IpV4.Port = "0"
+		c.Available(cfg)
+	}
+	// events keep being fired while the bridges start and stop
+	done := make(chan bool)
+	firing := make(chan bool)
+	go func() {
+		defer close(firing)
+		for {
+			select {
+			case <-done:
+				return
+			default:
+				event.Fire("test-bridged", "x")
+				runtime.Gosched()
+			}
+		}
+	}()
+	for i := 0; i < 10; i++ {
+		if e := c.Start(); e != nil {
+			t.Fatal(e)
+		}
+		time.Sleep(time.Millisecond)
+		if e := c.Stop(); e != nil {
+			t.Fatal(e)
+		}
+	}
+	close(done)
+	<-firing
+	event.Flush()
+}
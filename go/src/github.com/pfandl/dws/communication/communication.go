@@ -1,20 +1,15 @@
 package communication
 
 import (
+	"context"
+	"crypto/tls"
 	"github.com/pfandl/dws/debug"
-	"io"
+	"github.com/pfandl/dws/error"
 	"net"
+	"sync"
 	"time"
 )
 
-type CanRead interface {
-	Read(connection net.Conn) ([]byte, error)
-}
-
-type CanWrite interface {
-	Write(connection net.Conn, data []byte) (int, error)
-}
-
 type CanListen interface {
 	Listen(host string) error
 }
@@ -24,18 +19,42 @@ type CanTalk interface {
 }
 
 type Thread struct {
-	CanRead
-	CanWrite
 	CanListen
 	CanTalk
 	IsStoppable  bool
 	HasInterface interface{}
-	HasChannel   chan []byte
+	// connections are secured if set
+	HasTls *tls.Config
+	// handles the requests of peers, for a talker everything
+	// answering none of its requests, e.g. pushed events
+	HasHandler Handler
+	// guards connection
+	lock sync.Mutex
+	// connection of the talker, nil while not connected
+	connection *Connection
+}
+
+// Listen listens on addr, with tls if t is not nil.
+func Listen(addr string, t *tls.Config) (net.Listener, error) {
+	l, err := net.Listen("tcp", addr)
+	if err != nil || t == nil {
+		return l, err
+	}
+	return tls.NewListener(l, t), nil
+}
+
+// Dial connects to addr, with tls if t is not nil.
+func Dial(addr string, t *tls.Config, timeout time.Duration) (net.Conn, error) {
+	d := &net.Dialer{Timeout: timeout}
+	if t == nil {
+		return d.Dial("tcp", addr)
+	}
+	return tls.DialWithDialer(d, "tcp", addr, t)
 }
 
 func (this *Thread) Listen(host string) error {
 	debug.Ver("Thread Listen()")
-	if l, err := net.Listen("tcp", ":"+host); err != nil {
+	if l, err := Listen(":"+host, this.HasTls); err != nil {
 		return err
 	} else {
 		// run in thread
@@ -50,32 +69,6 @@ func (this *Thread) Talk(host string) error {
 	return nil
 }
 
-func (this *Thread) Read(connection net.Conn) ([]byte, error) {
-	var msg []byte
-
-	// should be enough for most messages
-	b := make([]byte, 2048)
-
-	for {
-		// we are looping to get all data
-		s, err := connection.Read(b)
-		if err != nil && err != io.EOF {
-			debug.Warn("Thread CanRead read failed %s", err.Error())
-			return nil, err
-		} else {
-			// EOF is a welcomed error
-			if s <= 0 {
-				// stop reading if EOF and no data left to read
-				break
-			}
-			// add part of message
-			msg = append(msg, b[0:s]...)
-		}
-	}
-
-	return msg, nil
-}
-
 func (this *Thread) Listener(listener net.Listener) {
 	debug.Ver("Thread Listener()")
 
@@ -90,67 +83,72 @@ func (this *Thread) Listener(listener net.Listener) {
 			continue
 		}
 
-		// connection established, further in an own thread
-		go func(connection net.Conn) {
-			debug.Ver("Thread Listener connection established with %s",
-				connection.LocalAddr().String())
-
-			if data, err := this.Read(connection); err != nil {
-				debug.Err(err.Error())
-			} else {
-				this.HasChannel <- data
-				result := <-this.HasChannel
-				if size, err := this.Write(connection, result); err != nil {
-					debug.Err(err.Error())
-				} else {
-					debug.Ver("Thread Listener wrote %d bytes - %v", size, result)
-				}
-			}
-
-			// close when returning
-			defer func() { connection.Close() }()
-		}(connection)
+		debug.Ver("Thread Listener connection established with %s",
+			connection.RemoteAddr().String())
+
+		// connection established, further in an own thread, it is
+		// kept until the peer closes it
+		go NewConnection(context.Background(), connection).Serve(this.HasHandler)
+	}
+}
+
+// dial connects to host, trying multiple times.
+func (this *Thread) dial(host string) (net.Conn, error) {
+	retries := 3
+
+	var connection net.Conn
+	var err error
+	for tried := 0; tried != retries; tried++ {
+		// if not first attempt
+		if tried > 0 {
+			// let some time pass
+			time.Sleep(1 * time.Second)
+		}
+		if connection, err = Dial(host, this.HasTls, 0); err == nil {
+			return connection, nil
+		}
 	}
+	return nil, err
 }
 
 func (this *Thread) Talker(host string) {
 	debug.Ver("Thread Talker(%s)", host)
 
-	retries := 3
-
 	this.IsStoppable = true
 	for this.IsStoppable {
-		// wait till we need to send data
-		data := <-this.HasChannel
-
-		var connection net.Conn
-		var err error
-		// try multiple times to establish a connection
-		tried := 0
-		for tried = 0; (tried == 0) || (err != nil) && (tried != retries); tried++ {
-			// if not first attempt
-			if tried > 0 {
-				// let some time pass
-				time.Sleep(1 * time.Second)
-			}
-			// dial
-			connection, err = net.Dial("tcp", host)
-		}
-
+		connection, err := this.dial(host)
 		if err != nil {
 			debug.Err("Thread Talker connection failed %s", err.Error())
-			this.HasChannel <- nil
 			continue
 		}
 
 		debug.Ver("Thread Talker connection established with %s",
 			connection.RemoteAddr().String())
 
-		if size, err := this.Write(connection, data); err != nil {
-			debug.Err(err.Error())
-			this.HasChannel <- nil
-		} else {
-			debug.Ver("Thread Talker wroe %d bytes - %v", size, data)
+		// the connection is used for all requests until it breaks
+		c := NewConnection(context.Background(), connection)
+		this.lock.Lock()
+		this.connection = c
+		this.lock.Unlock()
+		if err := c.Serve(this.HasHandler); err != nil {
+			debug.Warn("Thread Talker connection failed %s", err.Error())
 		}
+		this.lock.Lock()
+		this.connection = nil
+		this.lock.Unlock()
+		// let some time pass
+		time.Sleep(1 * time.Second)
+	}
+}
+
+// Request sends data with the id over the connection of the talker
+// and returns the answer, requests may be sent concurrently.
+func (this *Thread) Request(ctx context.Context, id string, data []byte) ([]byte, error) {
+	this.lock.Lock()
+	c := this.connection
+	this.lock.Unlock()
+	if c == nil {
+		return nil, err.New(ConnectionClosed)
 	}
+	return c.Request(ctx, id, data)
 }
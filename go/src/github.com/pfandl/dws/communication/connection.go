@@ -0,0 +1,251 @@
+package communication
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/pfandl/dws/debug"
+	"github.com/pfandl/dws/error"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+var (
+	// frames handled at the same time per connection, further
+	// frames are not read until one of them is done
+	MaxInFlight = 64
+	// frames queued for writing per connection
+	MaxQueued = 256
+	// for writing a single frame
+	WriteTimeout = 10 * time.Second
+	// errors
+	ConnectionClosed = "connection closed"
+	RequestPending   = "request with this id is pending"
+)
+
+// Handler handles a frame received on c.
+type Handler func(c *Connection, frame []byte)
+
+type connectionKey struct{}
+
+// Connection carries pipelined requests in both directions. Every frame
+// is handled in its own goroutine, answers are written in the order they
+// are done. A frame whose Id matches a request sent with Request answers
+// it, all other frames are handed to the handler of Serve.
+type Connection struct {
+	*Framer
+	ctx      context.Context
+	cancel   context.CancelFunc
+	out      chan []byte
+	inflight chan struct{}
+	// guards everything below
+	lock    sync.Mutex
+	pending map[string]chan []byte
+	closers []func()
+	closed  bool
+}
+
+func NewConnection(ctx context.Context, conn net.Conn) *Connection {
+	c := &Connection{
+		Framer:   NewFramer(conn),
+		out:      make(chan []byte, MaxQueued),
+		inflight: make(chan struct{}, MaxInFlight),
+		pending:  make(map[string]chan []byte),
+	}
+	c.ctx, c.cancel = context.WithCancel(context.WithValue(ctx, connectionKey{}, c))
+	go c.write()
+	return c
+}
+
+// FromContext returns the connection a frame handled with ctx was
+// received on, nil if there is none.
+func FromContext(ctx context.Context) *Connection {
+	c, _ := ctx.Value(connectionKey{}).(*Connection)
+	return c
+}
+
+// Context is done once c is closed, it carries c.
+func (c *Connection) Context() context.Context {
+	return c.ctx
+}
+
+// Serve reads frames until the peer closes the connection, waits for
+// the handlers still running and closes c.
+func (c *Connection) Serve(h Handler) error {
+	var wg sync.WaitGroup
+	var err error
+read:
+	for {
+		b, e := c.ReadFrame()
+		if e != nil {
+			if e != io.EOF {
+				err = e
+				// the peer is gone, do not bother answering
+				c.cancel()
+			}
+			break
+		}
+		if c.answer(b) == true || h == nil {
+			continue
+		}
+		select {
+		case c.inflight <- struct{}{}:
+		case <-c.ctx.Done():
+			break read
+		}
+		wg.Add(1)
+		go func(b []byte) {
+			defer func() {
+				<-c.inflight
+				wg.Done()
+			}()
+			h(c, b)
+		}(b)
+	}
+	wg.Wait()
+	c.Close()
+	return err
+}
+
+// write writes the queued frames, once c is closed the remaining
+// ones are written and the connection is closed.
+func (c *Connection) write() {
+	for {
+		select {
+		case b := <-c.out:
+			if e := c.send(b); e != nil {
+				debug.Warn("Connection write failed %s", e.Error())
+				c.Close()
+			}
+		case <-c.ctx.Done():
+			for {
+				select {
+				case b := <-c.out:
+					if e := c.send(b); e != nil {
+						c.Framer.Close()
+						return
+					}
+				default:
+					c.Framer.Close()
+					return
+				}
+			}
+		}
+	}
+}
+
+func (c *Connection) send(b []byte) error {
+	c.Connection.SetWriteDeadline(time.Now().Add(WriteTimeout))
+	_, e := c.WriteFrame(b)
+	return e
+}
+
+// Send queues the frame b, waiting if the queue is full.
+func (c *Connection) Send(b []byte) error {
+	if c.ctx.Err() != nil {
+		return err.New(ConnectionClosed)
+	}
+	select {
+	case c.out <- b:
+		return nil
+	case <-c.ctx.Done():
+		return err.New(ConnectionClosed)
+	}
+}
+
+// Push queues the frame b unless the queue is full, slow peers
+// must not hold up whoever pushes.
+func (c *Connection) Push(b []byte) bool {
+	if c.ctx.Err() != nil {
+		return false
+	}
+	select {
+	case c.out <- b:
+		return true
+	default:
+		return false
+	}
+}
+
+// Request sends the frame b with the id and returns the frame
+// answering it.
+func (c *Connection) Request(ctx context.Context, id string, b []byte) ([]byte, error) {
+	r := make(chan []byte, 1)
+	c.lock.Lock()
+	if c.closed == true {
+		c.lock.Unlock()
+		return nil, err.New(ConnectionClosed)
+	}
+	if c.pending[id] != nil {
+		c.lock.Unlock()
+		return nil, err.New(RequestPending, id)
+	}
+	c.pending[id] = r
+	c.lock.Unlock()
+	defer func() {
+		c.lock.Lock()
+		delete(c.pending, id)
+		c.lock.Unlock()
+	}()
+	if e := c.Send(b); e != nil {
+		return nil, e
+	}
+	select {
+	case b := <-r:
+		return b, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case <-c.ctx.Done():
+		return nil, err.New(ConnectionClosed)
+	}
+}
+
+// answer hands b to the request it answers.
+func (c *Connection) answer(b []byte) bool {
+	var id struct {
+		Id string
+	}
+	if e := json.Unmarshal(b, &id); e != nil || id.Id == "" {
+		return false
+	}
+	c.lock.Lock()
+	r := c.pending[id.Id]
+	delete(c.pending, id.Id)
+	c.lock.Unlock()
+	if r == nil {
+		return false
+	}
+	r <- b
+	return true
+}
+
+// OnClose calls f once c is closed.
+func (c *Connection) OnClose(f func()) {
+	c.lock.Lock()
+	if c.closed == true {
+		c.lock.Unlock()
+		f()
+		return
+	}
+	c.closers = append(c.closers, f)
+	c.lock.Unlock()
+}
+
+// Close closes c after writing the queued frames.
+func (c *Connection) Close() error {
+	c.lock.Lock()
+	if c.closed == true {
+		c.lock.Unlock()
+		return nil
+	}
+	c.closed = true
+	closers := c.closers
+	c.closers = nil
+	c.lock.Unlock()
+	c.cancel()
+	for _, f := range closers {
+		f()
+	}
+	return nil
+}
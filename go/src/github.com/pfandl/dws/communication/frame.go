@@ -0,0 +1,79 @@
+package communication
+
+import (
+	"bufio"
+	"bytes"
+	"github.com/pfandl/dws/error"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+)
+
+var (
+	// longest frame accepted, the connection is dropped on longer ones
+	MaxFrameSize = 1024 * 1024
+	// errors
+	FrameTooLarge   = "frame too large"
+	FrameHasNewline = "frame contains a newline"
+)
+
+// Framer reads and writes newline delimited frames on a connection,
+// every frame is a single json document. Empty lines are ignored, a
+// frame without newline is still accepted once the peer closes.
+type Framer struct {
+	Connection net.Conn
+	reader     *bufio.Reader
+	// guards writing, replies may be written concurrently
+	lock sync.Mutex
+}
+
+func NewFramer(c net.Conn) *Framer {
+	return &Framer{
+		Connection: c,
+		reader:     bufio.NewReader(c),
+	}
+}
+
+// ReadFrame returns the next frame without its newline.
+func (f *Framer) ReadFrame() ([]byte, error) {
+	var frame []byte
+	for {
+		line, e := f.reader.ReadSlice('\n')
+		if len(frame)+len(line) > MaxFrameSize+1 {
+			return nil, err.New(FrameTooLarge, strconv.Itoa(len(frame)+len(line)))
+		}
+		frame = append(frame, line...)
+		if e == bufio.ErrBufferFull {
+			continue
+		}
+		frame = bytes.TrimRight(frame, "\r\n")
+		if e == io.EOF && len(frame) > 0 {
+			return frame, nil
+		} else if e != nil {
+			return nil, e
+		}
+		if len(bytes.TrimSpace(frame)) == 0 {
+			frame = frame[:0]
+			continue
+		}
+		return frame, nil
+	}
+}
+
+// WriteFrame writes b followed by a newline.
+func (f *Framer) WriteFrame(b []byte) (int, error) {
+	if len(b) > MaxFrameSize {
+		return 0, err.New(FrameTooLarge, strconv.Itoa(len(b)))
+	}
+	if bytes.IndexByte(b, '\n') >= 0 {
+		return 0, err.New(FrameHasNewline)
+	}
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	return f.Connection.Write(append(b[:len(b):len(b)], '\n'))
+}
+
+func (f *Framer) Close() error {
+	return f.Connection.Close()
+}
@@ -0,0 +1,97 @@
+package communication
+
+import (
+	"io"
+	"net"
+	"strings"
+	"testing"
+)
+
+func TestReadFrame(t *testing.T) {
+	max := MaxFrameSize
+	MaxFrameSize = 8192
+	defer func() { MaxFrameSize = max }()
+
+	long := strings.Repeat("x", MaxFrameSize)
+	tests := []struct {
+		name   string
+		in     string
+		frames []string
+		err    string
+	}{
+		{"single", "{}\n", []string{"{}"}, ""},
+		{"several", "{}\n[]\n", []string{"{}", "[]"}, ""},
+		{"carriage return", "{}\r\n", []string{"{}"}, ""},
+		{"empty lines", "\n  \n{}\n", []string{"{}"}, ""},
+		{"no newline", "{}", []string{"{}"}, ""},
+		// longer than the buffer of the reader
+		{"longest", long + "\n", []string{long}, ""},
+		{"too long", long + "x\n", nil, FrameTooLarge},
+		{"too long without newline", long + "xx", nil, FrameTooLarge},
+		{"too long after a frame", "{}\n" + long + "x\n", []string{"{}"}, FrameTooLarge},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, p := net.Pipe()
+			defer c.Close()
+			go func() {
+				io.WriteString(p, tt.in)
+				p.Close()
+			}()
+			f := NewFramer(c)
+			for _, want := range tt.frames {
+				b, e := f.ReadFrame()
+				if e != nil || string(b) != want {
+					t.Fatalf("got %.20q %v, want %.20q", b, e, want)
+				}
+			}
+			_, e := f.ReadFrame()
+			if tt.err == "" {
+				if e != io.EOF {
+					t.Fatalf("got %v, want EOF", e)
+				}
+				return
+			}
+			if e == nil || strings.HasPrefix(e.Error(), tt.err) == false {
+				t.Fatalf("got %v, want %s", e, tt.err)
+			}
+		})
+	}
+}
+
+func TestWriteFrame(t *testing.T) {
+	tests := []struct {
+		name string
+		in   string
+		err  string
+	}{
+		{"frame", "{}", ""},
+		{"newline", "{}\n{}", FrameHasNewline},
+		{"too long", strings.Repeat("x", MaxFrameSize+1), FrameTooLarge},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, p := net.Pipe()
+			defer c.Close()
+			defer p.Close()
+			got := make(chan []byte, 1)
+			go func() {
+				b, _ := NewFramer(p).ReadFrame()
+				got <- b
+			}()
+			_, e := NewFramer(c).WriteFrame([]byte(tt.in))
+			if tt.err != "" {
+				if e == nil || strings.HasPrefix(e.Error(), tt.err) == false {
+					t.Fatalf("got %v, want %s", e, tt.err)
+				}
+				return
+			}
+			if e != nil {
+				t.Fatal(e)
+			}
+			if b := <-got; string(b) != tt.in {
+				t.Errorf("read %q, want %q", b, tt.in)
+			}
+		})
+	}
+}
@@ -1,16 +1,20 @@
 package config
 
 import (
+	"encoding/json"
 	"encoding/xml"
 	"github.com/pfandl/dws/data"
 	"github.com/pfandl/dws/debug"
 	"github.com/pfandl/dws/error"
 	"github.com/pfandl/dws/event"
 	"github.com/pfandl/dws/module"
+	"github.com/pfandl/dws/token"
 	"github.com/pfandl/dws/validation"
 	"io/ioutil"
 	"reflect"
+	"strconv"
 	"strings"
+	"sync"
 )
 
 const (
@@ -31,6 +35,9 @@ var (
 		"backingstore-available",
 		"network-available",
 		"host-available",
+		"plugin-available",
+		"bridge-available",
+		"gateway-available",
 		// events fired after executing commands
 		// when we return the result to server
 		"command-result",
@@ -39,8 +46,29 @@ var (
 		"check-command",
 	}
 	// events we are interested in
-	PassiveEvents = []string{
-		"command",
+	PassiveEvents = []string{}
+	// payloads of the events we fire
+	EventTypes = map[string]reflect.Type{
+		"server-available":       reflect.TypeOf(&Server{}),
+		"backingstore-available": reflect.TypeOf((*BackingStore)(nil)).Elem(),
+		"network-available":      reflect.TypeOf(&Network{}),
+		"host-available":         reflect.TypeOf(&Host{}),
+		"plugin-available":       reflect.TypeOf(&Plugin{}),
+		"bridge-available":       reflect.TypeOf(&Bridge{}),
+		"gateway-available":      reflect.TypeOf(&Gateway{}),
+		"command-result":         reflect.TypeOf(&data.Message{}),
+		"check-command":          reflect.TypeOf(&data.Message{}),
+	}
+	// fired while propagating the config, every module has to
+	// see them in order, e.g. a network before its hosts
+	Propagation = []string{
+		"server-available",
+		"backingstore-available",
+		"network-available",
+		"host-available",
+		"plugin-available",
+		"bridge-available",
+		"gateway-available",
 	}
 	// Paths to gather config information ascending in importance
 	Paths = []string{
@@ -75,6 +103,14 @@ var (
 	WrongSubnet                 = "subnets do not match"
 	ServerNotFound              = "server not found"
 	NetworkNotFound             = "network not found"
+	PluginNameAlreadyUsed       = "plugin name is already used"
+	BridgeNameAlreadyUsed       = "bridge name is already used"
+	GatewayNameAlreadyUsed      = "gateway name is already used"
+	SocketNeedsPath             = "socket needs a path"
+	SocketPathAlreadyUsed       = "socket path is already used"
+	AccessNeedsId               = "access needs a uid or gid"
+	InvalidId                   = "uid or gid is invalid"
+	InvalidPayload              = "command data has wrong type"
 	// messages
 	ServerAdded  = "server was added"
 	HostAdded    = "host was added"
@@ -101,6 +137,7 @@ type IpV4 struct {
 type ServerIpV4 struct {
 	IpV4    `validation:"struct" validation-ignore:"address,subnet,mac"`
 	XMLName xml.Name `xml:"ipv4"`
+	Tls     *Tls     `xml:"tls"`
 }
 
 type NetworkIpV4 struct {
@@ -118,6 +155,17 @@ type RemoteBackingStoreHostIpV4 struct {
 	XMLName xml.Name `xml:"ipv4"`
 }
 
+// the address of gateways and bridges is optional, see IsSane
+type GatewayIpV4 struct {
+	IpV4    `validation:"struct" validation-ignore:"address,subnet,mac"`
+	XMLName xml.Name `xml:"ipv4"`
+}
+
+type BridgeIpV4 struct {
+	IpV4    `validation:"struct" validation-ignore:"address,subnet,mac"`
+	XMLName xml.Name `xml:"ipv4"`
+}
+
 type HostIpV4 struct {
 	IpV4    `validation:"struct" validation-ignore:"subnet,port"`
 	XMLName xml.Name `xml:"ipv4"`
@@ -137,12 +185,14 @@ type LocalBackingStoreHost struct {
 	Host
 	XMLName xml.Name                  `xml:"host"`
 	IpV4    LocalBackingStoreHostIpV4 `xml:"ipv4"  validation:"struct"`
+	Tls     *Tls                      `xml:"tls"`
 }
 
 type RemoteBackingStoreHost struct {
 	Host
 	XMLName xml.Name                   `xml:"host"`
 	IpV4    RemoteBackingStoreHostIpV4 `xml:"ipv4"  validation:"struct"`
+	Tls     *Tls                       `xml:"tls"`
 }
 
 type Network struct {
@@ -186,11 +236,64 @@ type Server struct {
 	XMLName      xml.Name           `xml:"server"`
 	Name         string             `xml:"name,attr"    validation:"!empty"`
 	IpV4         ServerIpV4         `xml:"ipv4"         validation:"struct"`
+	Socket       *Socket            `xml:"socket"`
 	BackingStore RemoteBackingStore `xml:"backingstore" validation:"struct"`
 	Networks     []Network          `xml:"network"      validation:"slice"`
 	Log          Log                `xml:"log"`
 }
 
+// Socket is a local endpoint of a server. Only the owner of the daemon
+// and the members of Group may connect to it, on top of that callers
+// are authorized by the uid and groups of their process.
+type Socket struct {
+	SaneConfig
+	XMLName xml.Name `xml:"socket"`
+	Path    string   `xml:"path"`
+	// name or gid of the group owning the socket, may be empty
+	Group  string   `xml:"group"`
+	Access []Access `xml:"access"`
+}
+
+// Access grants permissions to the processes of a user or group.
+type Access struct {
+	XMLName     xml.Name            `xml:"access"`
+	Uid         string              `xml:"uid,attr"`
+	Gid         string              `xml:"gid,attr"`
+	Permissions []module.Permission `xml:"permission"`
+}
+
+type Plugin struct {
+	Propagate
+	SaneConfig
+	XMLName   xml.Name `xml:"plugin"`
+	Name      string   `xml:"name,attr" validation:"!empty"`
+	Path      string   `xml:"path"      validation:"!empty"`
+	Arguments []string `xml:"argument"`
+}
+
+// Bridge forwards events to another dws node, it connects to the
+// address if one is given and listens on the port otherwise.
+type Bridge struct {
+	Propagate
+	SaneConfig
+	XMLName xml.Name   `xml:"bridge"`
+	Name    string     `xml:"name,attr" validation:"!empty"`
+	IpV4    BridgeIpV4 `xml:"ipv4"      validation:"struct"`
+	Tls     *Tls       `xml:"tls"`
+	Events  []string   `xml:"event"`
+}
+
+// Gateway serves the config over http, it listens on the address
+// if one is given and on all addresses otherwise.
+type Gateway struct {
+	Propagate
+	SaneConfig
+	XMLName xml.Name    `xml:"gateway"`
+	Name    string      `xml:"name,attr" validation:"!empty"`
+	IpV4    GatewayIpV4 `xml:"ipv4"      validation:"struct"`
+	Tls     *Tls        `xml:"tls"`
+}
+
 type ConfigData struct {
 	Propagate
 	SaneConfig
@@ -198,9 +301,25 @@ type ConfigData struct {
 	Name          string              `xml:"name,attr"    validation:"!empty"`
 	Servers       []Server            `xml:"server"       validation:"slice"`
 	BackingStores []LocalBackingStore `xml:"backingstore" validation:"slice"`
+	Plugins       []Plugin            `xml:"plugin"       validation:"slice"`
+	Bridges       []Bridge            `xml:"bridge"       validation:"slice"`
+	Gateways      []Gateway           `xml:"gateway"      validation:"slice"`
+	Tokens        *Tokens             `xml:"tokens"`
 	Validate      bool
 }
 
+func init() {
+	// accepted commands are followed and journaled in the
+	// order the config accepted them
+	for _, e := range append([]string{"check-command"}, Propagation...) {
+		o := event.DefaultOptions
+		o.Mode = event.Ordered
+		if err := event.Configure(e, o); err != nil {
+			debug.Fat(err.Error())
+		}
+	}
+}
+
 func (d *ConfigData) Available() error {
 	debug.Ver("ConfigData: Available")
 
@@ -214,6 +333,21 @@ func (d *ConfigData) Available() error {
 			return err
 		}
 	}
+	for i := 0; i < len(d.Plugins); i++ {
+		if err := d.Plugins[i].Available(); err != nil {
+			return err
+		}
+	}
+	for i := 0; i < len(d.Bridges); i++ {
+		if err := d.Bridges[i].Available(); err != nil {
+			return err
+		}
+	}
+	for i := 0; i < len(d.Gateways); i++ {
+		if err := d.Gateways[i].Available(); err != nil {
+			return err
+		}
+	}
 
 	return nil
 }
@@ -241,6 +375,138 @@ func (d *ConfigData) IsSane(c *ConfigData, s string) error {
 			return err
 		}
 	}
+	for i := 0; i < len(c.Plugins); i++ {
+		p := &c.Plugins[i]
+		if err := p.IsSane(c, s); err != nil {
+			return err
+		}
+	}
+	for i := 0; i < len(c.Bridges); i++ {
+		b := &c.Bridges[i]
+		if err := b.IsSane(c, s); err != nil {
+			return err
+		}
+	}
+	for i := 0; i < len(c.Gateways); i++ {
+		g := &c.Gateways[i]
+		if err := g.IsSane(c, s); err != nil {
+			return err
+		}
+	}
+	if err := c.Tokens.IsSane(c, s); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func (d *Plugin) Available() error {
+	debug.Ver("Plugin: Available")
+	event.Fire("plugin-available", d)
+	return nil
+}
+
+func (d *Plugin) IsSane(c *ConfigData, s string) error {
+	debug.Ver("Plugin: IsSane")
+
+	// set to true after conf is read, this is to prevent
+	// double validation of data on config read
+	if c.Validate == true {
+		if err := validation.Validate(*d, s, ""); err != nil {
+			return err
+		}
+	}
+
+	for i := 0; i < len(c.Plugins); i++ {
+		p := &c.Plugins[i]
+		// skip same object (do not compare to itself)
+		if p == d {
+			continue
+		}
+		debug.Ver("Plugin: IsSane checking names %s %s", d.Name, p.Name)
+		if d.Name == p.Name {
+			return err.New(PluginNameAlreadyUsed, d.Name)
+		}
+	}
+
+	return nil
+}
+
+func (d *Bridge) Available() error {
+	debug.Ver("Bridge: Available")
+	event.Fire("bridge-available", d)
+	return nil
+}
+
+func (d *Bridge) IsSane(c *ConfigData, s string) error {
+	debug.Ver("Bridge: IsSane")
+
+	if c.Validate == true {
+		if err := validation.Validate(*d, s, ""); err != nil {
+			return err
+		}
+	}
+
+	// listening bridges have no address
+	if d.IpV4.Address != "" {
+		if err := validation.Validate(d.IpV4.Address, "", "ipv4"); err != nil {
+			return err
+		}
+		if err := d.Tls.IsSane(c, s); err != nil {
+			return err
+		}
+	} else if err := d.Tls.IsSaneListener(c, s); err != nil {
+		return err
+	}
+
+	for i := 0; i < len(c.Bridges); i++ {
+		b := &c.Bridges[i]
+		if b == d {
+			continue
+		}
+		if d.Name == b.Name {
+			return err.New(BridgeNameAlreadyUsed, d.Name)
+		}
+	}
+
+	return nil
+}
+
+func (d *Gateway) Available() error {
+	debug.Ver("Gateway: Available")
+	event.Fire("gateway-available", d)
+	return nil
+}
+
+func (d *Gateway) IsSane(c *ConfigData, s string) error {
+	debug.Ver("Gateway: IsSane")
+
+	if c.Validate == true {
+		if err := validation.Validate(*d, s, ""); err != nil {
+			return err
+		}
+	}
+
+	// gateways without address listen on all of them
+	if d.IpV4.Address != "" {
+		if err := validation.Validate(d.IpV4.Address, "", "ipv4"); err != nil {
+			return err
+		}
+	}
+
+	if err := d.Tls.IsSaneListener(c, s); err != nil {
+		return err
+	}
+
+	for i := 0; i < len(c.Gateways); i++ {
+		g := &c.Gateways[i]
+		if g == d {
+			continue
+		}
+		if d.Name == g.Name {
+			return err.New(GatewayNameAlreadyUsed, d.Name)
+		}
+	}
 
 	return nil
 }
@@ -318,6 +584,10 @@ func (d *LocalBackingStoreHost) IsSane(c *ConfigData, s string) error {
 		return err
 	}
 
+	if err := d.Tls.IsSaneListener(c, s); err != nil {
+		return err
+	}
+
 	return nil
 }
 
@@ -370,6 +640,16 @@ func (d *Server) IsSane(c *ConfigData, s string) error {
 		}
 	}
 
+	if err := d.IpV4.Tls.IsSaneListener(c, s); err != nil {
+		return err
+	}
+	if err := d.BackingStore.Host.Tls.IsSane(c, s); err != nil {
+		return err
+	}
+	if err := d.Socket.IsSane(c, s); err != nil {
+		return err
+	}
+
 	for i := 0; i < len(c.Servers); i++ {
 		s := &c.Servers[i]
 		// skip same object (do not compare to itself)
@@ -392,6 +672,59 @@ func (d *Server) IsSane(c *ConfigData, s string) error {
 	return nil
 }
 
+func (d *Socket) IsSane(c *ConfigData, s string) error {
+	debug.Ver("Socket: IsSane")
+	if d == nil {
+		return nil
+	}
+	if d.Path == "" {
+		return err.New(SocketNeedsPath)
+	}
+	for i := 0; i < len(c.Servers); i++ {
+		o := c.Servers[i].Socket
+		if o == nil || o == d {
+			continue
+		}
+		if d.Path == o.Path {
+			return err.New(SocketPathAlreadyUsed, d.Path)
+		}
+	}
+	for _, a := range d.Access {
+		if a.Uid == "" && a.Gid == "" {
+			return err.New(AccessNeedsId, d.Path)
+		}
+		for _, id := range []string{a.Uid, a.Gid} {
+			if _, e := strconv.ParseUint(id, 10, 32); id != "" && e != nil {
+				return err.New(InvalidId, id)
+			}
+		}
+		for _, p := range a.Permissions {
+			if _, e := module.ParsePermission(string(p)); e != nil {
+				return e
+			}
+		}
+	}
+	return nil
+}
+
+// Permissions returns what a process of the user uid in the
+// groups gids may do, nothing if no access matches.
+func (d *Socket) Permissions(uid string, gids []string) []module.Permission {
+	var r []module.Permission
+	for _, a := range d.Access {
+		match := a.Uid != "" && a.Uid == uid
+		for _, g := range gids {
+			if a.Gid != "" && a.Gid == g {
+				match = true
+			}
+		}
+		if match == true {
+			r = append(r, a.Permissions...)
+		}
+	}
+	return r
+}
+
 func (d *Network) Available() error {
 	debug.Ver("Network: Available")
 	event.Fire("network-available", d)
@@ -597,12 +930,42 @@ func (d *HostIpV4) IsSane(c *ConfigData, s string) error {
 type Config struct {
 	module.Module
 	Data *ConfigData
+	// guards Data against concurrent commands
+	lock sync.Mutex
+	// api tokens, nil if the config has none
+	tokens *token.Store
 }
 
 func (c *Config) Name() string {
 	return "config"
 }
 
+func (c *Config) Commands() []module.Command {
+	return append([]module.Command{
+		{
+			Name:        "add-server",
+			Type:        reflect.TypeOf(Server{}),
+			Permissions: []module.Permission{module.Write},
+			Help:        "adds a server listening for commands",
+			Handler:     c.handler(c.AddServer),
+		},
+		{
+			Name:        "add-network",
+			Type:        reflect.TypeOf(Network{}),
+			Permissions: []module.Permission{module.Write},
+			Help:        "adds a network to the server it names",
+			Handler:     c.handler(c.AddNetwork),
+		},
+		{
+			Name:        "add-host",
+			Type:        reflect.TypeOf(Host{}),
+			Permissions: []module.Permission{module.Write},
+			Help:        "adds a host to the network it names",
+			Handler:     c.handler(c.AddHost),
+		},
+	}, append(c.resources(), c.tokenCommands()...)...)
+}
+
 func (c *Config) Events(active bool) []string {
 	debug.Ver("Config: Events %v", active)
 	if active == true {
@@ -612,13 +975,15 @@ func (c *Config) Events(active bool) []string {
 	}
 }
 
+func (c *Config) EventTypes() map[string]reflect.Type {
+	return EventTypes
+}
+
 func (c *Config) Event(e string, v interface{}) {
 	debug.Ver("Config got event: %s %v", e, v)
 	switch e {
-	case "command":
-		c.Command(v.(*data.Message))
 	default:
-		debug.Fat("Config event %s unknown", e)
+		debug.Err("Config event %s unknown", e)
 	}
 }
 
@@ -662,6 +1027,11 @@ func (c *Config) Init() error {
 		// validate data in IsSane
 		c.Data.Validate = true
 
+		// callers need a token before anything is propagated
+		if err := c.openTokens(); err != nil {
+			return err
+		}
+
 		return c.Data.Available()
 	}
 	return err.New(NoConfig)
@@ -677,35 +1047,75 @@ func (c *Config) Stop() error {
 	return nil
 }
 
-func (c *Config) Command(m *data.Message) {
-	debug.Ver("Config Command: %v", m)
-	switch m.Message {
-	case "add-server":
-		c.AddServer(m)
-	case "add-network":
-		c.AddNetwork(m)
-	case "add-host":
-		c.AddHost(m)
+// Payload stores the data of m in v. Data decoded from json, e.g. when
+// the journal is replayed, arrives as generic maps and is converted,
+// m.Data is replaced by the typed value so other modules can rely on it.
+func Payload(m *data.Message, v interface{}) bool {
+	if m.Data == nil {
+		return false
+	}
+	p := reflect.ValueOf(v).Elem()
+	if d := reflect.ValueOf(m.Data); d.Type() == p.Type() {
+		p.Set(d)
+		return true
+	}
+	b, e := json.Marshal(m.Data)
+	if e != nil {
+		return false
+	}
+	if e := json.Unmarshal(b, v); e != nil {
+		return false
 	}
+	m.Data = p.Interface()
+	return true
 }
 
-func AfterCommand(m *data.Message) {
+// AfterCommand finishes the command m once the config handled it.
+// Accepted commands changing the config are passed on as check-command,
+// which is what the journal records. Its listeners share the message
+// and must not change it. Modules requiring the command answer it with
+// a copy, otherwise m is answered with the result message r if it
+// succeeded.
+func AfterCommand(m *data.Message, r ...string) {
+	cmd, _ := module.Lookup(m.Message)
+	if m.Succeeded == true && changes(cmd) == true {
+		c := *m
+		event.Fire("check-command", &c)
+		// the modules requiring the command should also check data
+		if len(cmd.Requires) > 0 {
+			return
+		}
+	}
 	if m.Succeeded == true {
-		// host module should also check data
-		event.Fire("check-command", m)
-	} else {
-		// something went wrong, inform server about that
-		event.Fire("command-result", m)
+		for _, r := range r {
+			m.Message = r
+		}
+	}
+	event.Fire("command-result", m)
+}
+
+// changes returns whether the command cmd changes the config.
+func changes(cmd module.Command) bool {
+	for _, p := range cmd.Permissions {
+		if p == module.Write {
+			return true
+		}
 	}
+	return false
 }
 
 func (c *Config) AddServer(m *data.Message) {
 	debug.Ver("Config AddServer: %v", m)
-	s := m.Data.(Server)
-
 	// fire result event after function is done
 	defer AfterCommand(m)
 
+	var s Server
+	if Payload(m, &s) == false {
+		m.Message = err.New(InvalidPayload, m.Message).Error()
+		m.Succeeded = false
+		return
+	}
+
 	if e := s.IsSane(c.Data, "address,subnet,mac"); e != nil {
 		// something is wrong with specified data
 		m.Message = e.Error()
@@ -718,22 +1128,26 @@ func (c *Config) AddServer(m *data.Message) {
 
 func (c *Config) AddNetwork(m *data.Message) {
 	debug.Ver("Config AddNetwork: %v", m)
-	n := m.Data.(Network)
-
 	// fire result event after function is done
 	defer AfterCommand(m)
 
+	var n Network
+	if Payload(m, &n) == false {
+		m.Message = err.New(InvalidPayload, m.Message).Error()
+		m.Succeeded = false
+		return
+	}
+
 	if e := n.IsSane(c.Data, "mac,port"); e != nil {
 		// something is wrong with specified data
 		m.Message = e.Error()
 		m.Succeeded = false
 	} else {
-		for _, s := range c.Data.Servers {
-			if s.Name == n.Server {
-				s.Networks = append(s.Networks, n)
-				m.Succeeded = true
-				return
-			}
+		if i := c.server(n.Server); i >= 0 {
+			s := &c.Data.Servers[i]
+			s.Networks = append(s.Networks, n)
+			m.Succeeded = true
+			return
 		}
 		// uhm... no network with this name found
 		m.Succeeded = false
@@ -743,24 +1157,26 @@ func (c *Config) AddNetwork(m *data.Message) {
 
 func (c *Config) AddHost(m *data.Message) {
 	debug.Ver("Config AddHost: %v", m)
-	h := m.Data.(Host)
-
 	// fire result event after function is done
-	defer AfterCommand(m)
+	defer AfterCommand(m, HostAdded)
+
+	var h Host
+	if Payload(m, &h) == false {
+		m.Message = err.New(InvalidPayload, m.Message).Error()
+		m.Succeeded = false
+		return
+	}
 
 	if e := h.IsSane(c.Data, "subnet,port"); e != nil {
 		// something is wrong with specified data
 		m.Message = e.Error()
 		m.Succeeded = false
 	} else {
-		for _, s := range c.Data.Servers {
-			for _, n := range s.Networks {
-				if n.Name == h.Network {
-					n.Hosts = append(n.Hosts, h)
-					m.Succeeded = true
-					return
-				}
-			}
+		if s, i := c.network(h.Network); i >= 0 {
+			n := &s.Networks[i]
+			n.Hosts = append(n.Hosts, h)
+			m.Succeeded = true
+			return
 		}
 		// uhm... no network with this name found
 		m.Succeeded = false
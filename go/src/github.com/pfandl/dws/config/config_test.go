@@ -0,0 +1,201 @@
+package config
+
+import (
+	"context"
+	"github.com/pfandl/dws/data"
+	"github.com/pfandl/dws/event"
+	"github.com/pfandl/dws/module"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestAfterCommand(t *testing.T) {
+	noop := func(ctx context.Context, m *data.Message) {}
+	for _, c := range []module.Command{
+		{Name: "update-server", Permissions: []module.Permission{module.Write}, Handler: noop},
+		{Name: "get-servers", Permissions: []module.Permission{module.Read}, Handler: noop},
+		{Name: "add-server", Permissions: []module.Permission{module.Write}, Handler: noop},
+	} {
+		if e := module.RegisterCommand("config", c); e != nil {
+			t.Fatal(e)
+		}
+	}
+	defer module.UnRegisterCommands("config")
+	// answered by the server
+	if e := module.RegisterCommand("server", module.Command{Name: "add-server"}); e != nil {
+		t.Fatal(e)
+	}
+	defer module.UnRegisterCommands("server")
+
+	var lock sync.Mutex
+	var fired []string
+	for _, s := range []string{"check-command", "command-result"} {
+		if _, e := event.RegisterEvent(s, reflect.TypeOf(&data.Message{})); e != nil {
+			t.Fatal(e)
+		}
+		defer event.UnRegisterEvent(s)
+		sub, e := event.Subscribe(s, func(s string, v interface{}) {
+			lock.Lock()
+			fired = append(fired, s+" "+v.(*data.Message).Message)
+			lock.Unlock()
+		})
+		if e != nil {
+			t.Fatal(e)
+		}
+		defer sub.Cancel()
+	}
+
+	tests := []struct {
+		command   string
+		succeeded bool
+		result    string
+		want      []string
+	}{
+		{"update-server", true, ServerUpdated, []string{"check-command update-server", "command-result " + ServerUpdated}},
+		{"update-server", false, ServerUpdated, []string{"command-result update-server"}},
+		{"get-servers", true, "", []string{"command-result get-servers"}},
+		{"add-server", true, "", []string{"check-command add-server"}},
+	}
+	for _, tt := range tests {
+		fired = nil
+		m := &data.Message{Message: tt.command, Succeeded: tt.succeeded}
+		if tt.result == "" {
+			AfterCommand(m)
+		} else {
+			AfterCommand(m, tt.result)
+		}
+		event.Flush()
+		lock.Lock()
+		got := append([]string{}, fired...)
+		lock.Unlock()
+		if len(got) != len(tt.want) {
+			t.Errorf("%s %v: fired %v, want %v", tt.command, tt.succeeded, got, tt.want)
+			continue
+		}
+		for _, w := range tt.want {
+			found := false
+			for _, g := range got {
+				found = found || g == w
+			}
+			if found == false {
+				t.Errorf("%s %v: fired %v, want %v", tt.command, tt.succeeded, got, tt.want)
+			}
+		}
+	}
+}
+
+func TestAfterCommandShared(t *testing.T) {
+	noop := func(ctx context.Context, m *data.Message) {}
+	for _, c := range []module.Command{
+		{Name: "add-server", Permissions: []module.Permission{module.Write}, Handler: noop},
+		{Name: "update-server", Permissions: []module.Permission{module.Write}, Handler: noop},
+	} {
+		if e := module.RegisterCommand("config", c); e != nil {
+			t.Fatal(e)
+		}
+	}
+	defer module.UnRegisterCommands("config")
+	if e := module.RegisterCommand("server", module.Command{Name: "add-server"}); e != nil {
+		t.Fatal(e)
+	}
+	defer module.UnRegisterCommands("server")
+	for _, s := range []string{"check-command", "command-result"} {
+		if _, e := event.RegisterEvent(s, reflect.TypeOf(&data.Message{})); e != nil {
+			t.Fatal(e)
+		}
+		defer event.UnRegisterEvent(s)
+	}
+
+	var lock sync.Mutex
+	var checked []*data.Message
+	// answers the command with the message it got, as modules did
+	sub, e := event.Subscribe("check-command", func(s string, v interface{}) {
+		m := v.(*data.Message)
+		lock.Lock()
+		checked = append(checked, m)
+		lock.Unlock()
+		m.Message = ServerAdded
+		m.Data = nil
+		m.Succeeded = false
+	})
+	if e != nil {
+		t.Fatal(e)
+	}
+	defer sub.Cancel()
+
+	tests := []struct {
+		command string
+		result  string
+	}{
+		{"add-server", "add-server"},
+		{"update-server", ServerUpdated},
+	}
+	for _, tt := range tests {
+		checked = nil
+		s := Server{Name: "test"}
+		m := &data.Message{Message: tt.command, Succeeded: true, Data: s}
+		AfterCommand(m, ServerUpdated)
+		event.Flush()
+		lock.Lock()
+		n := len(checked)
+		shared := n == 1 && checked[0] == m
+		lock.Unlock()
+		if n != 1 || shared == true {
+			t.Errorf("%s: checked %d messages, shared %v", tt.command, n, shared)
+		}
+		if m.Message != tt.result || m.Succeeded == false || reflect.DeepEqual(m.Data, s) == false {
+			t.Errorf("%s: message changed to %v", tt.command, m)
+		}
+	}
+}
+
+func TestCheckCommandOrdered(t *testing.T) {
+	noop := func(ctx context.Context, m *data.Message) {}
+	for _, c := range []module.Command{
+		{Name: "add-network", Permissions: []module.Permission{module.Write}, Handler: noop},
+		{Name: "remove-network", Permissions: []module.Permission{module.Write}, Handler: noop},
+	} {
+		if e := module.RegisterCommand("config", c); e != nil {
+			t.Fatal(e)
+		}
+	}
+	defer module.UnRegisterCommands("config")
+	for _, s := range []string{"check-command", "command-result"} {
+		if _, e := event.RegisterEvent(s, reflect.TypeOf(&data.Message{})); e != nil {
+			t.Fatal(e)
+		}
+		defer event.UnRegisterEvent(s)
+	}
+	var lock sync.Mutex
+	var got []string
+	sub, e := event.Subscribe("check-command", func(s string, v interface{}) {
+		m := v.(*data.Message)
+		// slow down additions, so removals would overtake them
+		if m.Message == "add-network" {
+			time.Sleep(time.Millisecond)
+		}
+		lock.Lock()
+		got = append(got, m.Message)
+		lock.Unlock()
+	})
+	if e != nil {
+		t.Fatal(e)
+	}
+	defer sub.Cancel()
+
+	var want []string
+	for i := 0; i < 20; i++ {
+		for _, s := range []string{"add-network", "remove-network"} {
+			want = append(want, s)
+			AfterCommand(&data.Message{Message: s, Succeeded: true, Data: "test"})
+		}
+	}
+	event.Flush()
+	lock.Lock()
+	defer lock.Unlock()
+	if reflect.DeepEqual(got, want) == false {
+		t.Errorf("followed %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,460 @@
+package config
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/pfandl/dws/data"
+	"github.com/pfandl/dws/debug"
+	"github.com/pfandl/dws/error"
+	"github.com/pfandl/dws/module"
+	"reflect"
+)
+
+var (
+	// errors
+	HostNotFound         = "host not found"
+	BackingStoreNotFound = "backing store not found"
+	// messages
+	ServerUpdated       = "server was updated"
+	ServerRemoved       = "server was removed"
+	NetworkUpdated      = "network was updated"
+	NetworkRemoved      = "network was removed"
+	HostUpdated         = "host was updated"
+	HostRemoved         = "host was removed"
+	BackingStoreAdded   = "backing store was added"
+	BackingStoreUpdated = "backing store was updated"
+	BackingStoreRemoved = "backing store was removed"
+)
+
+// resources returns the commands reading, changing and removing the
+// servers, networks, hosts and backing stores of the config. Getting
+// takes the name of a single one as payload, all are returned without.
+func (c *Config) resources() []module.Command {
+	name := reflect.TypeOf("")
+	return []module.Command{
+		{
+			Name:        "get-servers",
+			Type:        name,
+			Permissions: []module.Permission{module.Read},
+			Help:        "returns all servers or the one named by the payload",
+			Handler:     c.handler(c.GetServers),
+		},
+		{
+			Name:        "update-server",
+			Type:        reflect.TypeOf(Server{}),
+			Permissions: []module.Permission{module.Write},
+			Help:        "replaces the server of the same name, its networks are kept",
+			Handler:     c.handler(c.UpdateServer),
+		},
+		{
+			Name:        "remove-server",
+			Type:        name,
+			Permissions: []module.Permission{module.Write},
+			Help:        "removes the server named by the payload with its networks",
+			Handler:     c.handler(c.RemoveServer),
+		},
+		{
+			Name:        "get-networks",
+			Type:        name,
+			Permissions: []module.Permission{module.Read},
+			Help:        "returns all networks or the one named by the payload",
+			Handler:     c.handler(c.GetNetworks),
+		},
+		{
+			Name:        "update-network",
+			Type:        reflect.TypeOf(Network{}),
+			Permissions: []module.Permission{module.Write},
+			Help:        "replaces the network of the same name, its server and hosts are kept",
+			Handler:     c.handler(c.UpdateNetwork),
+		},
+		{
+			Name:        "remove-network",
+			Type:        name,
+			Permissions: []module.Permission{module.Write},
+			Help:        "removes the network named by the payload with its hosts",
+			Handler:     c.handler(c.RemoveNetwork),
+		},
+		{
+			Name:        "get-hosts",
+			Type:        name,
+			Permissions: []module.Permission{module.Read},
+			Help:        "returns all hosts or the one named by the payload",
+			Handler:     c.handler(c.GetHosts),
+		},
+		{
+			Name:        "update-host",
+			Type:        reflect.TypeOf(Host{}),
+			Permissions: []module.Permission{module.Write},
+			Help:        "replaces the host of the same name, its network is kept",
+			Handler:     c.handler(c.UpdateHost),
+		},
+		{
+			Name:        "remove-host",
+			Type:        name,
+			Permissions: []module.Permission{module.Write},
+			Help:        "removes the host named by the payload",
+			Handler:     c.handler(c.RemoveHost),
+		},
+		{
+			Name:        "get-backingstores",
+			Type:        name,
+			Permissions: []module.Permission{module.Read},
+			Help:        "returns all local backing stores or the one named by the payload",
+			Handler:     c.handler(c.GetBackingStores),
+		},
+		{
+			Name:        "add-backingstore",
+			Type:        reflect.TypeOf(LocalBackingStore{}),
+			Permissions: []module.Permission{module.Write},
+			Help:        "adds a local backing store",
+			Handler:     c.handler(c.AddBackingStore),
+		},
+		{
+			Name:        "update-backingstore",
+			Type:        reflect.TypeOf(LocalBackingStore{}),
+			Permissions: []module.Permission{module.Write},
+			Help:        "replaces the local backing store of the same name",
+			Handler:     c.handler(c.UpdateBackingStore),
+		},
+		{
+			Name:        "remove-backingstore",
+			Type:        name,
+			Permissions: []module.Permission{module.Write},
+			Help:        "removes the local backing store named by the payload",
+			Handler:     c.handler(c.RemoveBackingStore),
+		},
+	}
+}
+
+// handler returns a command handler calling f with the config locked.
+func (c *Config) handler(f func(m *data.Message)) module.Handler {
+	return func(ctx context.Context, m *data.Message) {
+		c.lock.Lock()
+		defer c.lock.Unlock()
+		f(m)
+	}
+}
+
+// named returns the name m carries as payload, empty if none.
+func named(m *data.Message) (string, bool) {
+	if m.Data == nil {
+		return "", true
+	}
+	s, ok := m.Data.(string)
+	return s, ok
+}
+
+// snapshot returns v encoded, the config may change while
+// the result is on its way.
+func snapshot(v interface{}) interface{} {
+	b, e := json.Marshal(v)
+	if e != nil {
+		return v
+	}
+	return json.RawMessage(b)
+}
+
+// fail answers m with the error e.
+func fail(m *data.Message, e error) {
+	m.Succeeded = false
+	m.Message = e.Error()
+	AfterCommand(m)
+}
+
+func (c *Config) server(s string) int {
+	for i := range c.Data.Servers {
+		if c.Data.Servers[i].Name == s {
+			return i
+		}
+	}
+	return -1
+}
+
+func (c *Config) network(s string) (*Server, int) {
+	for i := range c.Data.Servers {
+		srv := &c.Data.Servers[i]
+		for j := range srv.Networks {
+			if srv.Networks[j].Name == s {
+				return srv, j
+			}
+		}
+	}
+	return nil, -1
+}
+
+func (c *Config) host(s string) (*Network, int) {
+	for i := range c.Data.Servers {
+		srv := &c.Data.Servers[i]
+		for j := range srv.Networks {
+			n := &srv.Networks[j]
+			for k := range n.Hosts {
+				if n.Hosts[k].Name == s {
+					return n, k
+				}
+			}
+		}
+	}
+	return nil, -1
+}
+
+func (c *Config) backingStore(s string) int {
+	for i := range c.Data.BackingStores {
+		if c.Data.BackingStores[i].Name == s {
+			return i
+		}
+	}
+	return -1
+}
+
+func (c *Config) GetServers(m *data.Message) {
+	debug.Ver("Config GetServers: %v", m)
+	s, ok := named(m)
+	if ok == false {
+		fail(m, err.New(InvalidPayload, m.Message))
+		return
+	}
+	if s == "" {
+		m.Data = snapshot(append([]Server{}, c.Data.Servers...))
+	} else if i := c.server(s); i < 0 {
+		fail(m, err.New(ServerNotFound, s))
+		return
+	} else {
+		m.Data = snapshot(c.Data.Servers[i])
+	}
+	m.Succeeded = true
+	AfterCommand(m)
+}
+
+func (c *Config) UpdateServer(m *data.Message) {
+	debug.Ver("Config UpdateServer: %v", m)
+	var s Server
+	if Payload(m, &s) == false {
+		fail(m, err.New(InvalidPayload, m.Message))
+		return
+	}
+	i := c.server(s.Name)
+	if i < 0 {
+		fail(m, err.New(ServerNotFound, s.Name))
+		return
+	}
+	old := c.Data.Servers[i]
+	s.Networks = old.Networks
+	// checking in place, so the old server does not collide
+	c.Data.Servers[i] = s
+	if e := c.Data.Servers[i].IsSane(c.Data, "address,subnet,mac"); e != nil {
+		c.Data.Servers[i] = old
+		fail(m, e)
+		return
+	}
+	m.Succeeded = true
+	AfterCommand(m, ServerUpdated)
+}
+
+func (c *Config) RemoveServer(m *data.Message) {
+	debug.Ver("Config RemoveServer: %v", m)
+	s, ok := named(m)
+	i := c.server(s)
+	if ok == false || i < 0 {
+		fail(m, err.New(ServerNotFound, s))
+		return
+	}
+	c.Data.Servers = append(c.Data.Servers[:i:i], c.Data.Servers[i+1:]...)
+	m.Succeeded = true
+	AfterCommand(m, ServerRemoved)
+}
+
+func (c *Config) GetNetworks(m *data.Message) {
+	debug.Ver("Config GetNetworks: %v", m)
+	s, ok := named(m)
+	if ok == false {
+		fail(m, err.New(InvalidPayload, m.Message))
+		return
+	}
+	if s == "" {
+		r := []Network{}
+		for _, srv := range c.Data.Servers {
+			r = append(r, srv.Networks...)
+		}
+		m.Data = snapshot(r)
+	} else if srv, i := c.network(s); i < 0 {
+		fail(m, err.New(NetworkNotFound, s))
+		return
+	} else {
+		m.Data = snapshot(srv.Networks[i])
+	}
+	m.Succeeded = true
+	AfterCommand(m)
+}
+
+func (c *Config) UpdateNetwork(m *data.Message) {
+	debug.Ver("Config UpdateNetwork: %v", m)
+	var n Network
+	if Payload(m, &n) == false {
+		fail(m, err.New(InvalidPayload, m.Message))
+		return
+	}
+	srv, i := c.network(n.Name)
+	if i < 0 {
+		fail(m, err.New(NetworkNotFound, n.Name))
+		return
+	}
+	old := srv.Networks[i]
+	n.Server = old.Server
+	n.Hosts = old.Hosts
+	srv.Networks[i] = n
+	if e := srv.Networks[i].IsSane(c.Data, "mac,port"); e != nil {
+		srv.Networks[i] = old
+		fail(m, e)
+		return
+	}
+	m.Succeeded = true
+	AfterCommand(m, NetworkUpdated)
+}
+
+func (c *Config) RemoveNetwork(m *data.Message) {
+	debug.Ver("Config RemoveNetwork: %v", m)
+	s, ok := named(m)
+	srv, i := c.network(s)
+	if ok == false || i < 0 {
+		fail(m, err.New(NetworkNotFound, s))
+		return
+	}
+	srv.Networks = append(srv.Networks[:i:i], srv.Networks[i+1:]...)
+	m.Succeeded = true
+	AfterCommand(m, NetworkRemoved)
+}
+
+func (c *Config) GetHosts(m *data.Message) {
+	debug.Ver("Config GetHosts: %v", m)
+	s, ok := named(m)
+	if ok == false {
+		fail(m, err.New(InvalidPayload, m.Message))
+		return
+	}
+	if s == "" {
+		r := []Host{}
+		for _, srv := range c.Data.Servers {
+			for _, n := range srv.Networks {
+				r = append(r, n.Hosts...)
+			}
+		}
+		m.Data = snapshot(r)
+	} else if n, i := c.host(s); i < 0 {
+		fail(m, err.New(HostNotFound, s))
+		return
+	} else {
+		m.Data = snapshot(n.Hosts[i])
+	}
+	m.Succeeded = true
+	AfterCommand(m)
+}
+
+func (c *Config) UpdateHost(m *data.Message) {
+	debug.Ver("Config UpdateHost: %v", m)
+	var h Host
+	if Payload(m, &h) == false {
+		fail(m, err.New(InvalidPayload, m.Message))
+		return
+	}
+	n, i := c.host(h.Name)
+	if i < 0 {
+		fail(m, err.New(HostNotFound, h.Name))
+		return
+	}
+	old := n.Hosts[i]
+	h.Network = old.Network
+	n.Hosts[i] = h
+	if e := n.Hosts[i].IsSane(c.Data, "subnet,port"); e != nil {
+		n.Hosts[i] = old
+		fail(m, e)
+		return
+	}
+	m.Succeeded = true
+	AfterCommand(m, HostUpdated)
+}
+
+func (c *Config) RemoveHost(m *data.Message) {
+	debug.Ver("Config RemoveHost: %v", m)
+	s, ok := named(m)
+	n, i := c.host(s)
+	if ok == false || i < 0 {
+		fail(m, err.New(HostNotFound, s))
+		return
+	}
+	n.Hosts = append(n.Hosts[:i:i], n.Hosts[i+1:]...)
+	m.Succeeded = true
+	AfterCommand(m, HostRemoved)
+}
+
+func (c *Config) GetBackingStores(m *data.Message) {
+	debug.Ver("Config GetBackingStores: %v", m)
+	s, ok := named(m)
+	if ok == false {
+		fail(m, err.New(InvalidPayload, m.Message))
+		return
+	}
+	if s == "" {
+		m.Data = snapshot(append([]LocalBackingStore{}, c.Data.BackingStores...))
+	} else if i := c.backingStore(s); i < 0 {
+		fail(m, err.New(BackingStoreNotFound, s))
+		return
+	} else {
+		m.Data = snapshot(c.Data.BackingStores[i])
+	}
+	m.Succeeded = true
+	AfterCommand(m)
+}
+
+func (c *Config) AddBackingStore(m *data.Message) {
+	debug.Ver("Config AddBackingStore: %v", m)
+	var b LocalBackingStore
+	if Payload(m, &b) == false {
+		fail(m, err.New(InvalidPayload, m.Message))
+		return
+	}
+	c.Data.BackingStores = append(c.Data.BackingStores, b)
+	i := len(c.Data.BackingStores) - 1
+	if e := c.Data.BackingStores[i].IsSane(c.Data, ""); e != nil {
+		c.Data.BackingStores = c.Data.BackingStores[:i]
+		fail(m, e)
+		return
+	}
+	m.Succeeded = true
+	AfterCommand(m, BackingStoreAdded)
+}
+
+func (c *Config) UpdateBackingStore(m *data.Message) {
+	debug.Ver("Config UpdateBackingStore: %v", m)
+	var b LocalBackingStore
+	if Payload(m, &b) == false {
+		fail(m, err.New(InvalidPayload, m.Message))
+		return
+	}
+	i := c.backingStore(b.Name)
+	if i < 0 {
+		fail(m, err.New(BackingStoreNotFound, b.Name))
+		return
+	}
+	old := c.Data.BackingStores[i]
+	c.Data.BackingStores[i] = b
+	if e := c.Data.BackingStores[i].IsSane(c.Data, ""); e != nil {
+		c.Data.BackingStores[i] = old
+		fail(m, e)
+		return
+	}
+	m.Succeeded = true
+	AfterCommand(m, BackingStoreUpdated)
+}
+
+func (c *Config) RemoveBackingStore(m *data.Message) {
+	debug.Ver("Config RemoveBackingStore: %v", m)
+	s, ok := named(m)
+	i := c.backingStore(s)
+	if ok == false || i < 0 {
+		fail(m, err.New(BackingStoreNotFound, s))
+		return
+	}
+	c.Data.BackingStores = append(c.Data.BackingStores[:i:i], c.Data.BackingStores[i+1:]...)
+	m.Succeeded = true
+	AfterCommand(m, BackingStoreRemoved)
+}
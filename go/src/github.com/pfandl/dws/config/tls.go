@@ -0,0 +1,125 @@
+package config
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/xml"
+	"github.com/pfandl/dws/debug"
+	"github.com/pfandl/dws/error"
+	"io/ioutil"
+)
+
+var (
+	// errors
+	TlsNeedsCertAndKey = "tls needs a certificate and its key"
+	TlsInvalidCa       = "tls certificate authority contains no certificate"
+)
+
+// Tls secures a listener or dialer. A listener needs a certificate and
+// its key, with a certificate authority only clients presenting a
+// certificate signed by it are accepted. A dialer verifies the peer
+// with the certificate authority, or the system ones if there is none,
+// and presents its certificate if one is given.
+type Tls struct {
+	SaneConfig
+	XMLName xml.Name `xml:"tls"`
+	Cert    string   `xml:"cert"`
+	Key     string   `xml:"key"`
+	Ca      string   `xml:"ca"`
+	// name in the certificate of the peer, defaults to its address
+	ServerName string `xml:"servername"`
+}
+
+func (t *Tls) IsSane(c *ConfigData, s string) error {
+	debug.Ver("Tls: IsSane")
+	if t == nil {
+		return nil
+	}
+	if (t.Cert == "") != (t.Key == "") {
+		return err.New(TlsNeedsCertAndKey, t.Cert, t.Key)
+	}
+	return nil
+}
+
+// IsSaneListener is IsSane for the tls of a listener, it cannot do
+// without a certificate and its key.
+func (t *Tls) IsSaneListener(c *ConfigData, s string) error {
+	debug.Ver("Tls: IsSaneListener")
+	if t == nil {
+		return nil
+	}
+	if t.Cert == "" || t.Key == "" {
+		return err.New(TlsNeedsCertAndKey, t.Cert, t.Key)
+	}
+	return t.IsSane(c, s)
+}
+
+func (t *Tls) pool() (*x509.CertPool, error) {
+	if t.Ca == "" {
+		return nil, nil
+	}
+	b, e := ioutil.ReadFile(t.Ca)
+	if e != nil {
+		return nil, e
+	}
+	p := x509.NewCertPool()
+	if p.AppendCertsFromPEM(b) == false {
+		return nil, err.New(TlsInvalidCa, t.Ca)
+	}
+	return p, nil
+}
+
+// ListenConfig returns the config of a listener, nil if t is nil.
+func (t *Tls) ListenConfig() (*tls.Config, error) {
+	if t == nil {
+		return nil, nil
+	}
+	if t.Cert == "" || t.Key == "" {
+		return nil, err.New(TlsNeedsCertAndKey, t.Cert, t.Key)
+	}
+	cert, e := tls.LoadX509KeyPair(t.Cert, t.Key)
+	if e != nil {
+		return nil, e
+	}
+	p, e := t.pool()
+	if e != nil {
+		return nil, e
+	}
+	c := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}
+	if p != nil {
+		c.ClientCAs = p
+		c.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return c, nil
+}
+
+// DialConfig returns the config of a dialer connecting to the
+// address, nil if t is nil.
+func (t *Tls) DialConfig(address string) (*tls.Config, error) {
+	if t == nil {
+		return nil, nil
+	}
+	p, e := t.pool()
+	if e != nil {
+		return nil, e
+	}
+	c := &tls.Config{
+		RootCAs:    p,
+		ServerName: address,
+		MinVersion: tls.VersionTLS12,
+	}
+	if t.ServerName != "" {
+		c.ServerName = t.ServerName
+	}
+	if t.Cert != "" || t.Key != "" {
+		cert, e := tls.LoadX509KeyPair(t.Cert, t.Key)
+		if e != nil {
+			return nil, e
+		}
+		c.Certificates = []tls.Certificate{cert}
+	}
+	return c, nil
+}
@@ -0,0 +1,31 @@
+package config
+
+import (
+	"testing"
+)
+
+func TestTlsIsSane(t *testing.T) {
+	c := &ConfigData{}
+	full := &Tls{Cert: "cert.pem", Key: "key.pem"}
+	ca := &Tls{Ca: "ca.pem"}
+	tests := []struct {
+		name string
+		sane SaneConfig
+		fail bool
+	}{
+		{"gateway without tls", &Gateway{Name: "a"}, false},
+		{"gateway with cert", &Gateway{Name: "a", Tls: full}, false},
+		{"gateway without cert", &Gateway{Name: "a", Tls: ca}, true},
+		{"gateway with empty tls", &Gateway{Name: "a", Tls: &Tls{}}, true},
+		{"gateway with key only", &Gateway{Name: "a", Tls: &Tls{Key: "key.pem"}}, true},
+		{"listening bridge without cert", &Bridge{Name: "a", Tls: ca}, true},
+		{"dialing bridge without cert", &Bridge{Name: "a", IpV4: BridgeIpV4{IpV4: IpV4{Address: "10.0.0.1"}}, Tls: ca}, false},
+		{"dialing bridge with cert only", &Bridge{Name: "a", IpV4: BridgeIpV4{IpV4: IpV4{Address: "10.0.0.1"}}, Tls: &Tls{Cert: "cert.pem"}}, true},
+		{"backingstore without cert", &LocalBackingStoreHost{Tls: ca}, true},
+	}
+	for _, tt := range tests {
+		if e := tt.sane.IsSane(c, ""); (e != nil) != tt.fail {
+			t.Errorf("%s: got %v, want failure %v", tt.name, e, tt.fail)
+		}
+	}
+}
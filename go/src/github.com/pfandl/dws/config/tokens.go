@@ -0,0 +1,154 @@
+package config
+
+import (
+	"encoding/xml"
+	"github.com/pfandl/dws/data"
+	"github.com/pfandl/dws/debug"
+	"github.com/pfandl/dws/error"
+	"github.com/pfandl/dws/module"
+	"github.com/pfandl/dws/token"
+	"reflect"
+	"time"
+)
+
+var (
+	// errors
+	TokensNeedPath       = "tokens need a path"
+	TokensNotConfigured  = "tokens are not configured"
+	InvalidTokenValidity = "token validity is invalid"
+	// messages
+	TokenCreated = "token was created"
+	TokenRevoked = "token was revoked"
+)
+
+// Tokens names the file api tokens are kept in. With it every request
+// needs a token, callers of a socket are authorized by their
+// credentials instead.
+type Tokens struct {
+	SaneConfig
+	XMLName xml.Name `xml:"tokens"`
+	Path    string   `xml:"path"`
+}
+
+// TokenRequest is the payload of create-token.
+type TokenRequest struct {
+	Name        string
+	Permissions []module.Permission
+	// e.g. "720h", the token does not expire if empty
+	ValidFor string
+}
+
+func (d *Tokens) IsSane(c *ConfigData, s string) error {
+	debug.Ver("Tokens: IsSane")
+	if d == nil {
+		return nil
+	}
+	if d.Path == "" {
+		return err.New(TokensNeedPath)
+	}
+	return nil
+}
+
+// openTokens opens the token file of the config and makes
+// requests authenticate with its tokens.
+func (c *Config) openTokens() error {
+	if c.Data.Tokens == nil {
+		return nil
+	}
+	s, e := token.Open(c.Data.Tokens.Path)
+	if e != nil {
+		return e
+	}
+	c.tokens = s
+	module.SetAuthenticator(s.Authenticate)
+	return nil
+}
+
+func (c *Config) tokenCommands() []module.Command {
+	return []module.Command{
+		{
+			Name:        "create-token",
+			Type:        reflect.TypeOf(TokenRequest{}),
+			Permissions: []module.Permission{module.Admin},
+			Help:        "creates a token granting the permissions, its secret is only returned once",
+			Handler:     c.handler(c.CreateToken),
+		},
+		{
+			Name:        "revoke-token",
+			Type:        reflect.TypeOf(""),
+			Permissions: []module.Permission{module.Admin},
+			Help:        "revokes the token named by the payload",
+			Handler:     c.handler(c.RevokeToken),
+		},
+		{
+			Name:        "list-tokens",
+			Permissions: []module.Permission{module.Admin},
+			Help:        "lists all tokens with their permissions and expiry",
+			Handler:     c.handler(c.ListTokens),
+		},
+	}
+}
+
+func (c *Config) CreateToken(m *data.Message) {
+	debug.Ver("Config CreateToken")
+	if c.tokens == nil {
+		fail(m, err.New(TokensNotConfigured))
+		return
+	}
+	var r TokenRequest
+	if Payload(m, &r) == false {
+		fail(m, err.New(InvalidPayload, m.Message))
+		return
+	}
+	var expires time.Time
+	if r.ValidFor != "" {
+		d, e := time.ParseDuration(r.ValidFor)
+		if e != nil || d <= 0 {
+			fail(m, err.New(InvalidTokenValidity, r.ValidFor))
+			return
+		}
+		expires = time.Now().Add(d)
+	}
+	t, e := c.tokens.Create(r.Name, r.Permissions, expires)
+	if e != nil {
+		fail(m, e)
+		return
+	}
+	// the secret goes to the caller only
+	m.Private = true
+	m.Data = t
+	m.Succeeded = true
+	m.Message = TokenCreated
+	AfterCommand(m)
+}
+
+func (c *Config) RevokeToken(m *data.Message) {
+	debug.Ver("Config RevokeToken: %v", m)
+	if c.tokens == nil {
+		fail(m, err.New(TokensNotConfigured))
+		return
+	}
+	s, ok := named(m)
+	if ok == false || s == "" {
+		fail(m, err.New(token.TokenNotFound, s))
+		return
+	}
+	if e := c.tokens.Revoke(s); e != nil {
+		fail(m, e)
+		return
+	}
+	m.Succeeded = true
+	m.Message = TokenRevoked
+	AfterCommand(m)
+}
+
+func (c *Config) ListTokens(m *data.Message) {
+	debug.Ver("Config ListTokens: %v", m)
+	if c.tokens == nil {
+		fail(m, err.New(TokensNotConfigured))
+		return
+	}
+	m.Data = c.tokens.List()
+	m.Succeeded = true
+	AfterCommand(m)
+}
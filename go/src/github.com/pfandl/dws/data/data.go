@@ -16,10 +16,27 @@ type IsJsonCompatible interface {
 
 type Message struct {
 	IsJsonCompatible
+	Id        string
 	Succeeded bool
 	Message   string
 	Data      interface{}
-	Interface *interface{}
+	// the result is only answered to the caller, e.g. as it
+	// contains a secret, it is never pushed to subscribers
+	Private bool `json:"-"`
+}
+
+func (m *Message) CorrelationId() string {
+	return m.Id
+}
+
+func (m *Message) SetCorrelationId(s string) {
+	m.Id = s
+}
+
+// IsPrivate reports whether v is a message that must not be pushed.
+func IsPrivate(v interface{}) bool {
+	m, ok := v.(*Message)
+	return ok == true && m.Private == true
 }
 
 func (m *Message) ToJson() string {
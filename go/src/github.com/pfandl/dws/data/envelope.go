@@ -0,0 +1,162 @@
+package data
+
+import (
+	"encoding/json"
+	"reflect"
+)
+
+const (
+	// version of the envelope spoken by this daemon
+	Version = 1
+)
+
+var (
+	// error codes
+	CodeInvalidEnvelope    = "invalid-envelope"
+	CodeUnsupportedVersion = "unsupported-version"
+	CodeInvalidPayload     = "invalid-payload"
+	CodeUnknownCommand     = "unknown-command"
+	CodeUnavailable        = "unavailable"
+	CodeUnauthorized       = "unauthorized"
+	CodeForbidden          = "forbidden"
+	CodeFailed             = "failed"
+	// errors
+	UnsupportedVersion = "unsupported protocol version"
+	CommandNeeded      = "envelope needs a command"
+)
+
+// Error tells a client why its request failed.
+type Error struct {
+	Code    string
+	Message string
+}
+
+// Envelope is what clients and the daemon exchange. A reply carries
+// the Id and Command of its request and either Error or the result as
+// Payload. Events pushed by the daemon carry no Id but the name of the
+// Event and its value as Payload.
+type Envelope struct {
+	Version int
+	Id      string
+	Command string          `json:",omitempty"`
+	Event   string          `json:",omitempty"`
+	Payload json.RawMessage `json:",omitempty"`
+	// authenticates a request, never part of an answer
+	Token string `json:",omitempty"`
+	// human readable outcome of a request
+	Message string `json:",omitempty"`
+	Error   *Error `json:",omitempty"`
+}
+
+func (e *Error) Error() string {
+	return e.Code + ": " + e.Message
+}
+
+// ParseEnvelope decodes and checks an envelope sent by a client.
+func ParseEnvelope(b []byte) (*Envelope, *Error) {
+	e := &Envelope{}
+	if err := json.Unmarshal(b, e); err != nil {
+		return e, &Error{Code: CodeInvalidEnvelope, Message: err.Error()}
+	}
+	if e.Version != Version {
+		return e, &Error{Code: CodeUnsupportedVersion, Message: UnsupportedVersion}
+	}
+	if e.Command == "" {
+		return e, &Error{Code: CodeInvalidEnvelope, Message: CommandNeeded}
+	}
+	return e, nil
+}
+
+// Decode returns the message to dispatch for e, the payload is
+// decoded into a value of type t unless t is nil.
+func (e *Envelope) Decode(t reflect.Type) (*Message, *Error) {
+	m := &Message{Message: e.Command}
+	if len(e.Payload) == 0 {
+		return m, nil
+	}
+	var p interface{} = &m.Data
+	if t != nil {
+		p = reflect.New(t).Interface()
+	}
+	if err := json.Unmarshal(e.Payload, p); err != nil {
+		return nil, &Error{Code: CodeInvalidPayload, Message: err.Error()}
+	}
+	if t != nil {
+		m.Data = reflect.ValueOf(p).Elem().Interface()
+	}
+	return m, nil
+}
+
+// Reply returns the answer to e, failing with err if it is not nil.
+func (e *Envelope) Reply(err *Error) *Envelope {
+	return &Envelope{
+		Version: Version,
+		Id:      e.Id,
+		Command: e.Command,
+		Error:   err,
+	}
+}
+
+// Result returns the answer to e carrying the result m of the command.
+func (e *Envelope) Result(m *Message) *Envelope {
+	if m.Succeeded == false {
+		return e.Reply(&Error{Code: CodeFailed, Message: m.Message})
+	}
+	r := e.Reply(nil)
+	r.Message = m.Message
+	if m.Data != nil {
+		b, err := json.Marshal(m.Data)
+		if err != nil {
+			return e.Reply(&Error{Code: CodeFailed, Message: CannotConvertToJson})
+		}
+		r.Payload = b
+	}
+	return r
+}
+
+// Push returns the envelope pushing the event s with the value v.
+func Push(s string, v interface{}) (*Envelope, error) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	return &Envelope{
+		Version: Version,
+		Event:   s,
+		Payload: b,
+	}, nil
+}
+
+// Matches reports whether the payload of e is an object having the
+// fields of f, values other than strings are compared as json.
+func (e *Envelope) Matches(f map[string]string) bool {
+	if len(f) == 0 {
+		return true
+	}
+	var p map[string]json.RawMessage
+	if err := json.Unmarshal(e.Payload, &p); err != nil {
+		return false
+	}
+	for k, v := range f {
+		raw, ok := p[k]
+		if ok == false {
+			return false
+		}
+		var s string
+		if err := json.Unmarshal(raw, &s); err != nil {
+			s = string(raw)
+		}
+		if s != v {
+			return false
+		}
+	}
+	return true
+}
+
+func (e *Envelope) ToJson() []byte {
+	b, err := json.Marshal(e)
+	if err != nil {
+		b, _ = json.Marshal(e.Reply(&Error{Code: CodeFailed, Message: CannotConvertToJson}))
+	}
+	return b
+}
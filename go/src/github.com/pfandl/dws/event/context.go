@@ -0,0 +1,92 @@
+package event
+
+import (
+	"context"
+	"github.com/pfandl/dws/debug"
+	"github.com/pfandl/dws/error"
+	"sync"
+	"time"
+)
+
+var (
+	// errors
+	HandlerTimeout = "handler timed out"
+
+	// guards root and cancelRoot
+	rootLock         sync.Mutex
+	root, cancelRoot = context.WithCancel(context.Background())
+)
+
+// IsContextListener is implemented by listeners that want the
+// context of a delivery, it is done once the delivery timed out
+// or the Fire it came from was cancelled.
+type IsContextListener interface {
+	ExtinguishContext(ctx context.Context, v interface{})
+}
+
+// Background returns the context Fire uses, it is
+// cancelled by Shutdown.
+func Background() context.Context {
+	rootLock.Lock()
+	defer rootLock.Unlock()
+	return root
+}
+
+// Shutdown cancels the contexts of all deliveries fired so far,
+// everything fired afterwards gets a new context.
+func Shutdown() {
+	rootLock.Lock()
+	defer rootLock.Unlock()
+	cancelRoot()
+	root, cancelRoot = context.WithCancel(context.Background())
+}
+
+// bound runs f with ctx, limited to timeout if there is one. A handler
+// exceeding its timeout is left behind and treated like a panic, so
+// that it cannot stall the deliveries queued after it.
+func (a *ActiveEvent) bound(ctx context.Context, timeout time.Duration, name string, f func(context.Context)) func() {
+	return func() {
+		if ctx.Err() != nil {
+			debug.Ver("Event %s: not delivered to %s (%s)", a.Name, name, ctx.Err().Error())
+			return
+		}
+		if timeout <= 0 {
+			f(ctx)
+			return
+		}
+		c, cancel := context.WithTimeout(ctx, timeout)
+		defer cancel()
+		done := make(chan struct{})
+		var p interface{}
+		go func() {
+			defer func() {
+				p = recover()
+				close(done)
+			}()
+			f(c)
+		}()
+		select {
+		case <-done:
+			if p != nil {
+				panic(p)
+			}
+		case <-c.Done():
+			if ctx.Err() == nil {
+				panic(err.New(HandlerTimeout, a.Name, name, timeout.String()))
+			}
+			debug.Ver("Event %s: abandoned %s (%s)", a.Name, name, ctx.Err().Error())
+		}
+	}
+}
+
+// FireContext fires s like Fire, the deliveries get ctx.
+func FireContext(ctx context.Context, s string, v interface{}) error {
+	if a := get(s); a != nil {
+		return a.FireContext(ctx, v)
+	}
+	return err.New(EventNotFound, s)
+}
+
+func (a *ActiveEvent) FireContext(ctx context.Context, v interface{}) error {
+	return a.fire(ctx, v, nil)
+}
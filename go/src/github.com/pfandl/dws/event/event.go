@@ -1,34 +1,103 @@
 package event
 
 import (
+	"context"
+	"encoding/json"
 	"github.com/pfandl/dws/error"
+	"reflect"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
+type Mode int
+
+const (
+	// deliveries are processed by a pool of workers in any order
+	Parallel Mode = iota
+	// deliveries are processed by Fire before it returns
+	Synchronous
+	// deliveries to the same subscriber are processed one after another
+	// in the order they were fired, over all events in this mode
+	Ordered
+)
+
+type Policy int
+
+const (
+	// Fire waits until there is room in the queue
+	Block Policy = iota
+	// the event being fired is dropped if the queue is full
+	DropNewest
+	// the oldest queued delivery is dropped to make room
+	DropOldest
+)
+
 var (
-	Asynchronous = true
-	Events       = make(map[string]*ActiveEvent)
+	// used for events that were not configured
+	DefaultOptions = Options{
+		Mode:    Parallel,
+		Workers: 4,
+		Queue:   256,
+		Policy:  Block,
+	}
 	// errors
 	EventAlreadyRegistered    = "event already registered"
 	EventNotFound             = "event not found"
 	CallbackAlreadyRegistered = "callback already registered"
 	CallbackNotFound          = "callback not found"
-	// next id for asynchronous events
-	NextId = uint64(0)
+	InvalidOptions            = "invalid event options"
+	PayloadMismatch           = "event payload type mismatch"
+	TypeAlreadyRegistered     = "event registered with different payload type"
+
+	// guards events and options
+	lock    sync.RWMutex
+	events  = make(map[string]*ActiveEvent)
+	options = make(map[string]Options)
+	// deliveries not yet finished over all events
+	inflight     int
+	inflightLock sync.Mutex
+	inflightCond = sync.NewCond(&inflightLock)
 )
 
+// Options control how deliveries of an event are processed.
+type Options struct {
+	Mode Mode
+	// goroutines delivering the event to its subscribers in Parallel mode
+	Workers int
+	// deliveries that may wait for a worker, or in Ordered mode for
+	// their subscriber, before Policy applies
+	Queue  int
+	Policy Policy
+	// how long a delivery may take, 0 waits forever
+	Timeout time.Duration
+}
+
 type _activeEvent interface {
-	Fire(interface{})
+	Fire(interface{}) error
 	Register(_passiveEvent) error
-	RegisterCallback(func(interface{})) error
+	RegisterCallback(*func(string, interface{})) error
 	UnRegister(_passiveEvent) error
-	UnRegisterCallback(func(interface{})) error
+	UnRegisterCallback(*func(string, interface{})) error
 }
 
 type _passiveEvent interface {
 	Extinguish(interface{})
 }
 
+// HasSubscriber is implemented by listeners that share their
+// Ordered queue with other listeners of the same subscriber.
+type HasSubscriber interface {
+	Subscriber() string
+}
+
+// IsDispatcher is implemented by listeners that hand deliveries on to
+// handlers of their own and recover their failures themselves. They are
+// never quarantined, that would silence all of their handlers at once.
+type IsDispatcher interface {
+	Dispatcher()
+}
+
 type _event interface {
 	_activeEvent
 	_passiveEvent
@@ -36,26 +105,128 @@ type _event interface {
 
 type ActiveEvent struct {
 	_activeEvent
-	Listeners  []_passiveEvent
-	Unfinished []uint64
-	Callbacks  []*func(string, interface{})
-	Name       string
+	Name string
+	// guards everything below
+	lock sync.RWMutex
+	// expected payload, nil accepts anything
+	Type      reflect.Type
+	listeners []_passiveEvent
+	callbacks []*func(string, interface{})
+	options   Options
+	queue     *queue
+	closed    bool
+	dropped   atomic.Uint64
+	// subscriber keys that failed too often, see guard
+	quarantined sync.Map
+}
+
+// queue holds the deliveries waiting for the workers of an event.
+type queue struct {
+	c chan func()
+	// Fire calls that might still send to c, it is
+	// closed once they are done
+	senders sync.WaitGroup
+}
+
+// close closes q once nobody sends to it anymore, the
+// workers drain it and exit.
+func (q *queue) close() {
+	go func() {
+		q.senders.Wait()
+		close(q.c)
+	}()
+}
+
+func started() {
+	inflightLock.Lock()
+	inflight++
+	inflightLock.Unlock()
+}
+
+func finished() {
+	inflightLock.Lock()
+	inflight--
+	if inflight == 0 {
+		inflightCond.Broadcast()
+	}
+	inflightLock.Unlock()
+}
+
+func (o Options) valid() bool {
+	if o.Timeout < 0 {
+		return false
+	}
+	switch o.Mode {
+	case Parallel:
+		// dropping the oldest delivery needs a queue to drop it from
+		if o.Policy == DropOldest && o.Queue == 0 {
+			return false
+		}
+		return o.Workers > 0 && o.Queue >= 0
+	case Synchronous:
+		return true
+	case Ordered:
+		return o.Queue >= 0
+	}
+	return false
+}
+
+// start creates the queue and the workers serving it,
+// must be called with the lock held.
+func (a *ActiveEvent) start() {
+	a.queue = &queue{c: make(chan func(), a.options.Queue)}
+	if a.options.Mode != Parallel {
+		// no workers needed
+		return
+	}
+	for i := 0; i < a.options.Workers; i++ {
+		go func(q chan func()) {
+			for f := range q {
+				f()
+				finished()
+			}
+		}(a.queue.c)
+	}
+}
+
+// stop lets the workers finish all queued deliveries and exit.
+func (a *ActiveEvent) stop() {
+	a.lock.Lock()
+	a.closed = true
+	q := a.queue
+	a.lock.Unlock()
+	q.close()
+}
+
+func (a *ActiveEvent) configure(o Options) {
+	a.lock.Lock()
+	old := a.queue
+	a.options = o
+	a.start()
+	a.lock.Unlock()
+	// the old workers drain the old queue and exit
+	old.close()
 }
 
 func (a *ActiveEvent) Register(p _passiveEvent) error {
-	for i := 0; i < len(a.Listeners); i++ {
-		if a.Listeners[i] == p {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	for i := 0; i < len(a.listeners); i++ {
+		if a.listeners[i] == p {
 			return err.New(EventAlreadyRegistered)
 		}
 	}
-	a.Listeners = append(a.Listeners, p)
+	a.listeners = append(a.listeners, p)
 	return nil
 }
 
 func (a *ActiveEvent) UnRegister(p _passiveEvent) error {
-	for i := 0; i < len(a.Listeners); i++ {
-		if a.Listeners[i] == p {
-			a.Listeners = append(a.Listeners[:i], a.Listeners[i+1:]...)
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	for i := 0; i < len(a.listeners); i++ {
+		if a.listeners[i] == p {
+			// copy, Fire might still iterate the old slice
+			a.listeners = append(append([]_passiveEvent{}, a.listeners[:i]...), a.listeners[i+1:]...)
 			return nil
 		}
 	}
@@ -63,137 +234,331 @@ func (a *ActiveEvent) UnRegister(p _passiveEvent) error {
 }
 
 func (a *ActiveEvent) RegisterCallback(c *func(string, interface{})) error {
-	for i := 0; i < len(a.Callbacks); i++ {
-		if a.Callbacks[i] == c {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	for i := 0; i < len(a.callbacks); i++ {
+		if a.callbacks[i] == c {
 			return err.New(CallbackAlreadyRegistered)
 		}
 	}
-	a.Callbacks = append(a.Callbacks, c)
+	a.callbacks = append(a.callbacks, c)
 	return nil
 }
 
 func (a *ActiveEvent) UnRegisterCallback(c *func(string, interface{})) error {
-	for i := 0; i < len(a.Callbacks); i++ {
-		if a.Callbacks[i] == c {
-			a.Callbacks = append(a.Callbacks[:i], a.Callbacks[i+1:]...)
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	for i := 0; i < len(a.callbacks); i++ {
+		if a.callbacks[i] == c {
+			a.callbacks = append(append([]*func(string, interface{}){}, a.callbacks[:i]...), a.callbacks[i+1:]...)
 			return nil
 		}
 	}
 	return err.New(CallbackNotFound)
 }
 
-func (a *ActiveEvent) Asynchronous(f func()) {
-	// grab next id
-	id := NextId
-	// and increase it
-	NextId++
-	// append this id to unfinished list
-	a.Unfinished = append(a.Unfinished, id)
-	go func(u uint64) {
-		// execute passed function
-		f()
-		// remove this id from unfinished list
-		for i := 0; i < len(a.Unfinished); i++ {
-			if a.Unfinished[i] == u {
-				a.Unfinished = append(a.Unfinished[:i], a.Unfinished[i+1:]...)
-				break
+// Dropped returns how many deliveries were dropped
+// because the queue was full.
+func (a *ActiveEvent) Dropped() uint64 {
+	return a.dropped.Load()
+}
+
+// enqueue hands f to the workers serving q according to the policy p,
+// the caller must be one of the senders of q.
+func (a *ActiveEvent) enqueue(q *queue, p Policy, f func()) {
+	started()
+	switch p {
+	case DropNewest:
+		select {
+		case q.c <- f:
+		default:
+			a.dropped.Add(1)
+			finished()
+		}
+	case DropOldest:
+		for {
+			select {
+			case q.c <- f:
+				return
+			default:
+			}
+			// make room, a worker might have been faster
+			select {
+			case <-q.c:
+				a.dropped.Add(1)
+				finished()
+			default:
 			}
 		}
-	}(id)
+	default:
+		q.c <- f
+	}
 }
 
-func (a *ActiveEvent) Fire(v interface{}) {
-	for _, l := range a.Listeners {
+// Accepts returns an error if v is not of the payload type of a.
+func (a *ActiveEvent) Accepts(v interface{}) error {
+	a.lock.RLock()
+	defer a.lock.RUnlock()
+	return a.accepts(v)
+}
+
+func (a *ActiveEvent) accepts(v interface{}) error {
+	if a.Type == nil {
+		return nil
+	}
+	if v == nil {
+		switch a.Type.Kind() {
+		case reflect.Ptr, reflect.Interface, reflect.Map, reflect.Slice:
+			return nil
+		}
+		return err.New(PayloadMismatch, a.Name, "nil", a.Type.String())
+	}
+	if t := reflect.TypeOf(v); t.AssignableTo(a.Type) == false {
+		return err.New(PayloadMismatch, a.Name, t.String(), a.Type.String())
+	}
+	return nil
+}
+
+func (a *ActiveEvent) Fire(v interface{}) error {
+	return a.fire(Background(), v, nil)
+}
+
+// fire delivers v to all subscribers except the callback skip. The
+// lock is only held to take the subscribers, delivering may block.
+func (a *ActiveEvent) fire(ctx context.Context, v interface{}, skip *func(string, interface{})) error {
+	a.lock.RLock()
+	if e := a.accepts(v); e != nil {
+		a.lock.RUnlock()
+		return e
+	}
+	if a.closed == true {
+		a.lock.RUnlock()
+		return nil
+	}
+	// both are copied on removal, appending leaves our part alone
+	listeners := a.listeners
+	own := a.callbacks
+	o := a.options
+	q := a.queue
+	if o.Mode == Parallel {
+		q.senders.Add(1)
+		defer q.senders.Done()
+	}
+	a.lock.RUnlock()
+
+	var names []string
+	var keys []interface{}
+	var exempt []bool
+	var deliveries []func(context.Context)
+	for _, l := range listeners {
 		// IMPORTANT!!!!
-		// cannot use 'l' in asynchronous callback function as it
+		// cannot use 'l' in the delivery function as it
 		// would be overwritten by the next loop and thus only a
-		// subset of callbacks (or the last one) will be called!
+		// subset of listeners (or the last one) will be called!
 		ll := l
-		if Asynchronous == true {
-			a.Asynchronous(func() { ll.Extinguish(v) })
+		k := subscriber(l)
+		if a.isQuarantined(k) == true {
+			continue
+		}
+		_, d := l.(IsDispatcher)
+		names = append(names, describe(l))
+		keys = append(keys, k)
+		exempt = append(exempt, d)
+		if cl, ok := l.(IsContextListener); ok == true {
+			deliveries = append(deliveries, func(ctx context.Context) { cl.ExtinguishContext(ctx, v) })
 		} else {
-			l.Extinguish(v)
+			deliveries = append(deliveries, func(context.Context) { ll.Extinguish(v) })
 		}
 	}
-	for _, c := range a.Callbacks {
-		// IMPORTANT!!!!
-		// cannot use 'c' in asynchronous callback function as it
-		// would be overwritten by the next loop and thus only a
-		// subset of callbacks (or the last one) will be called!
+	// never append to a.callbacks itself, other calls of Fire share it
+	callbacks := append(matching(a.Name), own...)
+	for _, c := range callbacks {
 		cc := *c
-		if Asynchronous == true {
-			a.Asynchronous(func() { cc(a.Name, v) })
-		} else {
-			cc(a.Name, v)
+		if c == skip || a.isQuarantined(c) == true {
+			continue
+		}
+		names = append(names, describe(cc))
+		keys = append(keys, c)
+		exempt = append(exempt, false)
+		deliveries = append(deliveries, func(context.Context) { cc(a.Name, v) })
+	}
+	t := trace(a.Name, v, names)
+	for i, f := range deliveries {
+		b := a.bound(ctx, o.Timeout, names[i], f)
+		g := a.guard(keys[i], exempt[i], names[i], v, t.call(i, b))
+		switch o.Mode {
+		case Synchronous:
+			g()
+		case Ordered:
+			order(keys[i], a, o, g)
+		default:
+			a.enqueue(q, o.Policy, g)
 		}
 	}
+	return nil
 }
 
 type PassiveEvent struct {
 	_passiveEvent
 }
 
-func SetAsynchronous(b bool) {
-	Asynchronous = b
+// Configure sets the options for the event s. Options of an already
+// registered event are applied right away, queued deliveries are
+// still processed by the old workers.
+func Configure(s string, o Options) error {
+	if o.valid() == false {
+		return err.New(InvalidOptions, s)
+	}
+	lock.Lock()
+	options[s] = o
+	a := events[s]
+	lock.Unlock()
+	if a != nil {
+		a.configure(o)
+	}
+	return nil
+}
+
+func get(s string) *ActiveEvent {
+	lock.RLock()
+	defer lock.RUnlock()
+	return events[s]
 }
 
-func RegisterEvent(s string) (*ActiveEvent, error) {
-	if Events[s] == nil {
-		a := &ActiveEvent{Name: s}
-		Events[s] = a
+// RegisterEvent registers the event s. If a payload type t is passed,
+// firing s with anything not assignable to t fails. Registering an
+// existing event again is fine as long as the types do not conflict.
+func RegisterEvent(s string, t ...reflect.Type) (*ActiveEvent, error) {
+	var tt reflect.Type
+	for _, t := range t {
+		tt = t
+	}
+	lock.Lock()
+	defer lock.Unlock()
+	if a := events[s]; a != nil {
+		if tt != nil {
+			a.lock.Lock()
+			defer a.lock.Unlock()
+			if a.Type != nil && a.Type != tt {
+				return a, err.New(TypeAlreadyRegistered, s, a.Type.String(), tt.String())
+			}
+			a.Type = tt
+		}
 		return a, nil
 	}
-	return Events[s], nil
+	o, ok := options[s]
+	if ok == false {
+		o = DefaultOptions
+	}
+	a := &ActiveEvent{Name: s, Type: tt, options: o}
+	a.start()
+	events[s] = a
+	return a, nil
+}
+
+// Type returns the payload type of the event s, nil if
+// it accepts anything or is not registered.
+func Type(s string) reflect.Type {
+	if a := get(s); a != nil {
+		return a.PayloadType()
+	}
+	return nil
+}
+
+// Decode decodes b into the payload type of the event s, events
+// without a payload type get the generic json representation.
+func Decode(s string, b []byte) (interface{}, error) {
+	var v interface{}
+	if len(b) == 0 {
+		return v, nil
+	}
+	var p interface{} = &v
+	t := Type(s)
+	if t != nil {
+		p = reflect.New(t).Interface()
+	}
+	if e := json.Unmarshal(b, p); e != nil {
+		return nil, e
+	}
+	if t != nil {
+		v = reflect.ValueOf(p).Elem().Interface()
+	}
+	return v, nil
+}
+
+func (a *ActiveEvent) PayloadType() reflect.Type {
+	a.lock.RLock()
+	defer a.lock.RUnlock()
+	return a.Type
 }
 
 func UnRegisterEvent(s string) error {
-	if Events[s] != nil {
-		delete(Events, s)
+	lock.Lock()
+	a := events[s]
+	delete(events, s)
+	lock.Unlock()
+	if a != nil {
+		a.stop()
 		return nil
 	}
 	return err.New(EventNotFound, s)
 }
 
 func RegisterListener(s string, p _passiveEvent) error {
-	if Events[s] != nil {
-		return Events[s].Register(p)
+	if a := get(s); a != nil {
+		return a.Register(p)
 	}
 	return err.New(EventNotFound, s)
 }
 
 func UnRegisterListener(s string, p _passiveEvent) error {
-	if Events[s] != nil {
-		return Events[s].UnRegister(p)
+	if a := get(s); a != nil {
+		return a.UnRegister(p)
 	}
 	return err.New(EventNotFound, s)
 }
 
 func RegisterCallback(s string, c func(string, interface{})) error {
-	if Events[s] != nil {
-		return Events[s].RegisterCallback(&c)
+	if a := get(s); a != nil {
+		return a.RegisterCallback(&c)
 	}
 	return err.New(EventNotFound, s)
 }
 
 func UnRegisterCallback(s string, c func(string, interface{})) error {
-	if Events[s] != nil {
-		return Events[s].UnRegisterCallback(&c)
+	if a := get(s); a != nil {
+		return a.UnRegisterCallback(&c)
 	}
 	return err.New(EventNotFound, s)
 }
 
 func Fire(s string, v interface{}) error {
-	if Events[s] != nil {
-		Events[s].Fire(v)
-		return nil
+	if a := get(s); a != nil {
+		return a.Fire(v)
 	}
 	return err.New(EventNotFound, s)
 }
 
-func Flush() {
-	for _, e := range Events {
-		for len(e.Unfinished) > 0 {
-			time.Sleep(1 * time.Millisecond)
+// FireExcept fires v like Fire but does not deliver it to the
+// subscription skip, e.g. so that a forwarder is not handed back
+// the events it fires itself.
+func FireExcept(s string, v interface{}, skip *Subscription) error {
+	if a := get(s); a != nil {
+		var c *func(string, interface{})
+		if skip != nil {
+			c = skip.callback
 		}
+		return a.fire(Background(), v, c)
+	}
+	return err.New(EventNotFound, s)
+}
+
+// Flush waits until all deliveries fired so far are done. Must not be
+// called from within a listener or callback, it would wait for itself.
+func Flush() {
+	inflightLock.Lock()
+	for inflight > 0 {
+		inflightCond.Wait()
 	}
+	inflightLock.Unlock()
 }
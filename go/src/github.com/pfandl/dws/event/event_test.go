@@ -0,0 +1,292 @@
+package event
+
+import (
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// register registers the event s with the options o, it is
+// unregistered once the test is done.
+func register(t testing.TB, s string, o Options) *ActiveEvent {
+	t.Helper()
+	if e := Configure(s, o); e != nil {
+		t.Fatal(e)
+	}
+	a, e := RegisterEvent(s)
+	if e != nil {
+		t.Fatal(e)
+	}
+	t.Cleanup(func() {
+		UnRegisterEvent(s)
+		lock.Lock()
+		delete(options, s)
+		lock.Unlock()
+	})
+	return a
+}
+
+// within fails the test if f does not return in time.
+func within(t *testing.T, name string, f func()) {
+	t.Helper()
+	done := make(chan bool)
+	go func() {
+		f()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(3 * time.Second):
+		t.Fatalf("%s: did not return", name)
+	}
+}
+
+func TestConfigure(t *testing.T) {
+	tests := []struct {
+		name  string
+		o     Options
+		valid bool
+	}{
+		{"default", DefaultOptions, true},
+		{"synchronous", Options{Mode: Synchronous}, true},
+		{"ordered unbuffered", Options{Mode: Ordered, Policy: DropOldest}, true},
+		{"no workers", Options{Mode: Parallel, Queue: 1}, false},
+		{"negative queue", Options{Mode: Parallel, Workers: 1, Queue: -1}, false},
+		{"negative timeout", Options{Mode: Synchronous, Timeout: -time.Second}, false},
+		{"unknown mode", Options{Mode: Mode(42)}, false},
+		{"unbuffered drop oldest", Options{Mode: Parallel, Workers: 1, Policy: DropOldest}, false},
+		{"unbuffered drop newest", Options{Mode: Parallel, Workers: 1, Policy: DropNewest}, true},
+	}
+	for _, tt := range tests {
+		e := Configure("test-configure", tt.o)
+		if (e == nil) != tt.valid {
+			t.Errorf("%s: got %v, want valid %v", tt.name, e, tt.valid)
+		}
+	}
+	lock.Lock()
+	delete(options, "test-configure")
+	lock.Unlock()
+}
+
+func TestModes(t *testing.T) {
+	tests := []struct {
+		name string
+		o    Options
+		// deliveries arrive in the order they were fired
+		ordered bool
+	}{
+		{"parallel", Options{Mode: Parallel, Workers: 4, Queue: 8}, false},
+		{"parallel unbuffered", Options{Mode: Parallel, Workers: 1}, true},
+		{"synchronous", Options{Mode: Synchronous}, true},
+		{"ordered", Options{Mode: Ordered, Queue: 8}, true},
+	}
+	for _, tt := range tests {
+		s := "test-mode-" + tt.name
+		register(t, s, tt.o)
+		var lock sync.Mutex
+		var got []int
+		sub, e := Subscribe(s, func(s string, v int) {
+			lock.Lock()
+			got = append(got, v)
+			lock.Unlock()
+		})
+		if e != nil {
+			t.Fatal(e)
+		}
+		within(t, tt.name, func() {
+			for i := 0; i < 100; i++ {
+				Fire(s, i)
+			}
+			Flush()
+		})
+		sub.Cancel()
+		if len(got) != 100 {
+			t.Errorf("%s: %d delivered, want 100", tt.name, len(got))
+			continue
+		}
+		for i := 0; tt.ordered == true && i < len(got); i++ {
+			if got[i] != i {
+				t.Errorf("%s: delivery %d is %d", tt.name, i, got[i])
+				break
+			}
+		}
+	}
+}
+
+func TestPolicies(t *testing.T) {
+	tests := []struct {
+		name string
+		o    Options
+		// deliveries handled, the first one blocks until all are fired
+		delivered int
+		// payload of the last handled delivery
+		last int
+	}{
+		{"parallel block", Options{Mode: Parallel, Workers: 1, Queue: 2, Policy: Block}, 5, 4},
+		{"parallel drop newest", Options{Mode: Parallel, Workers: 1, Queue: 2, Policy: DropNewest}, 3, 2},
+		{"parallel drop oldest", Options{Mode: Parallel, Workers: 1, Queue: 2, Policy: DropOldest}, 3, 4},
+		{"ordered drop newest", Options{Mode: Ordered, Queue: 2, Policy: DropNewest}, 3, 2},
+		{"ordered drop oldest", Options{Mode: Ordered, Queue: 2, Policy: DropOldest}, 3, 4},
+	}
+	for _, tt := range tests {
+		s := "test-policy-" + tt.name
+		a := register(t, s, tt.o)
+		release := make(chan bool)
+		busy := make(chan bool)
+		var lock sync.Mutex
+		var got []int
+		sub, e := Subscribe(s, func(s string, v int) {
+			if v == 0 {
+				close(busy)
+				<-release
+			}
+			lock.Lock()
+			got = append(got, v)
+			lock.Unlock()
+		})
+		if e != nil {
+			t.Fatal(e)
+		}
+		Fire(s, 0)
+		<-busy
+		fired := make(chan bool)
+		go func() {
+			for i := 1; i < 5; i++ {
+				Fire(s, i)
+			}
+			close(fired)
+		}()
+		if tt.o.Policy != Block {
+			<-fired
+		}
+		close(release)
+		within(t, tt.name, func() {
+			<-fired
+			Flush()
+		})
+		sub.Cancel()
+		if len(got) != tt.delivered || got[len(got)-1] != tt.last {
+			t.Errorf("%s: got %v, want %d ending with %d", tt.name, got, tt.delivered, tt.last)
+		}
+		if d := a.Dropped(); d != uint64(5-tt.delivered) {
+			t.Errorf("%s: %d dropped, want %d", tt.name, d, 5-tt.delivered)
+		}
+	}
+}
+
+// subscribing from within a delivery needs the lock of the event
+func TestFireReleasesLock(t *testing.T) {
+	tests := []struct {
+		name string
+		o    Options
+	}{
+		{"synchronous", Options{Mode: Synchronous}},
+		{"ordered", Options{Mode: Ordered, Queue: 1}},
+		{"parallel", Options{Mode: Parallel, Workers: 1, Queue: 1}},
+	}
+	for _, tt := range tests {
+		s := "test-lock-" + tt.name
+		register(t, s, tt.o)
+		var subs []*Subscription
+		var lock sync.Mutex
+		sub, e := Subscribe(s, func(n string, v int) {
+			ss, e := Subscribe(n, func(string, int) {})
+			if e != nil {
+				t.Errorf("%s: %v", tt.name, e)
+				return
+			}
+			lock.Lock()
+			subs = append(subs, ss)
+			lock.Unlock()
+		})
+		if e != nil {
+			t.Fatal(e)
+		}
+		within(t, tt.name, func() {
+			Fire(s, 1)
+			Flush()
+		})
+		sub.Cancel()
+		for _, ss := range subs {
+			ss.Cancel()
+		}
+	}
+}
+
+// firing while the event is unregistered must not send to a closed queue
+func TestFireWhileUnregistering(t *testing.T) {
+	for i := 0; i < 50; i++ {
+		s := "test-unregister"
+		if _, e := RegisterEvent(s); e != nil {
+			t.Fatal(e)
+		}
+		sub, _ := Subscribe(s, func(string, int) {})
+		var wg sync.WaitGroup
+		for j := 0; j < 4; j++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for k := 0; k < 100; k++ {
+					Fire(s, k)
+				}
+			}()
+		}
+		UnRegisterEvent(s)
+		wg.Wait()
+		sub.Cancel()
+	}
+	within(t, "flush", Flush)
+}
+
+func benchmark(b *testing.B, o Options) {
+	s := "benchmark"
+	register(b, s, o)
+	var delivered atomic.Uint64
+	for i := 0; i < 4; i++ {
+		sub, e := Subscribe(s, func(string, interface{}) {
+			delivered.Add(1)
+		})
+		if e != nil {
+			b.Fatal(e)
+		}
+		defer sub.Cancel()
+	}
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			Fire(s, nil)
+		}
+	})
+	Flush()
+	b.StopTimer()
+	b.ReportMetric(float64(delivered.Load())/float64(b.N), "deliveries/op")
+}
+
+func BenchmarkFireParallelBlock(b *testing.B) {
+	benchmark(b, Options{Mode: Parallel, Workers: 4, Queue: 256, Policy: Block})
+}
+
+func BenchmarkFireParallelDropNewest(b *testing.B) {
+	benchmark(b, Options{Mode: Parallel, Workers: 4, Queue: 256, Policy: DropNewest})
+}
+
+func BenchmarkFireParallelDropOldest(b *testing.B) {
+	benchmark(b, Options{Mode: Parallel, Workers: 4, Queue: 256, Policy: DropOldest})
+}
+
+func BenchmarkFireSynchronous(b *testing.B) {
+	benchmark(b, Options{Mode: Synchronous})
+}
+
+func BenchmarkFireOrderedBlock(b *testing.B) {
+	benchmark(b, Options{Mode: Ordered, Queue: 256, Policy: Block})
+}
+
+func BenchmarkFireOrderedDropNewest(b *testing.B) {
+	benchmark(b, Options{Mode: Ordered, Queue: 256, Policy: DropNewest})
+}
+
+func BenchmarkFireOrderedDropOldest(b *testing.B) {
+	benchmark(b, Options{Mode: Ordered, Queue: 256, Policy: DropOldest})
+}
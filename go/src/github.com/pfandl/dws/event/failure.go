@@ -0,0 +1,151 @@
+package event
+
+import (
+	"fmt"
+	"github.com/pfandl/dws/debug"
+	"github.com/pfandl/dws/error"
+	"reflect"
+	rdebug "runtime/debug"
+	"sync"
+	"time"
+)
+
+var (
+	// failures of a subscription within FailureWindow
+	// after which it is quarantined
+	MaxFailures   = 3
+	FailureWindow = time.Minute
+	// fired with a *Failure whenever a subscriber panics
+	ErrorEvent = "event-error"
+	// errors
+	NotQuarantined = "subscription not quarantined"
+
+	// guards failures
+	failureLock sync.Mutex
+	failures    = make(map[failureKey]*Failure)
+)
+
+type failureKey struct {
+	event      string
+	subscriber interface{}
+}
+
+// Failure describes a panic of a subscriber while handling an event.
+type Failure struct {
+	Event      string
+	Subscriber string
+	Payload    string
+	Panic      string
+	Stack      string
+	Time       time.Time
+	// failures within FailureWindow including this one
+	Failures    int
+	Quarantined bool
+}
+
+func init() {
+	if _, e := RegisterEvent(ErrorEvent, reflect.TypeOf(&Failure{})); e != nil {
+		debug.Fat(e.Error())
+	}
+}
+
+// guard runs f and recovers a panic of it, the failure is reported
+// with an ErrorEvent and the subscriber k is quarantined for the
+// event a once it failed too often, unless it is exempt.
+func (a *ActiveEvent) guard(k interface{}, exempt bool, name string, v interface{}, f func()) func() {
+	return func() {
+		defer func() {
+			r := recover()
+			if r == nil {
+				return
+			}
+			fl := a.fail(k, exempt, &Failure{
+				Event:      a.Name,
+				Subscriber: name,
+				Payload:    summarize(v),
+				Panic:      fmt.Sprint(r),
+				Stack:      string(rdebug.Stack()),
+				Time:       time.Now(),
+			})
+			debug.Err("Event %s: %s panicked (%s)", a.Name, name, fl.Panic)
+			if fl.Quarantined == true {
+				debug.Err("Event %s: %s quarantined after %d failures", a.Name, name, fl.Failures)
+			}
+			if a.Name == ErrorEvent {
+				// never report failures of reporting failures
+				return
+			}
+			if e := Fire(ErrorEvent, fl); e != nil {
+				debug.Err("Event %s: cannot report failure (%s)", a.Name, e.Error())
+			}
+		}()
+		f()
+	}
+}
+
+// fail counts the failure fl of the subscriber k and
+// quarantines k if needed.
+func (a *ActiveEvent) fail(k interface{}, exempt bool, fl *Failure) *Failure {
+	failureLock.Lock()
+	defer failureLock.Unlock()
+	fk := failureKey{event: a.Name, subscriber: k}
+	fl.Failures = 1
+	if old := failures[fk]; old != nil && fl.Time.Sub(old.Time) < FailureWindow {
+		fl.Failures = old.Failures + 1
+		// keep the time of the first failure in the window
+		fl.Time = old.Time
+	}
+	if fl.Failures >= MaxFailures && exempt == false {
+		fl.Quarantined = true
+		a.quarantined.Store(k, fl)
+	}
+	failures[fk] = fl
+	c := *fl
+	c.Time = time.Now()
+	return &c
+}
+
+// isQuarantined reports whether deliveries to k are suppressed.
+func (a *ActiveEvent) isQuarantined(k interface{}) bool {
+	_, ok := a.quarantined.Load(k)
+	return ok
+}
+
+// Quarantined returns the failures that caused subscriptions
+// of the event s to be quarantined.
+func Quarantined(s string) []Failure {
+	var r []Failure
+	if a := get(s); a != nil {
+		a.quarantined.Range(func(k, v interface{}) bool {
+			r = append(r, *v.(*Failure))
+			return true
+		})
+	}
+	return r
+}
+
+// Release delivers the event s to its quarantined subscriber named n
+// again, e.g. after the module owning it was restarted. An empty name
+// releases all quarantined subscribers of s.
+func Release(s string, n string) error {
+	a := get(s)
+	if a == nil {
+		return err.New(EventNotFound, s)
+	}
+	released := 0
+	a.quarantined.Range(func(k, v interface{}) bool {
+		if n != "" && v.(*Failure).Subscriber != n {
+			return true
+		}
+		a.quarantined.Delete(k)
+		failureLock.Lock()
+		delete(failures, failureKey{event: s, subscriber: k})
+		failureLock.Unlock()
+		released++
+		return true
+	})
+	if released == 0 {
+		return err.New(NotQuarantined, s, n)
+	}
+	return nil
+}
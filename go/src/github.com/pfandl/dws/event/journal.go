@@ -0,0 +1,363 @@
+package event
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"github.com/pfandl/dws/debug"
+	"github.com/pfandl/dws/error"
+	"hash/crc32"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	// superseded records tolerated before a journal is compacted on open
+	CompactAfter = 64
+	// records larger than this are considered corrupt
+	MaxRecordSize = 1 << 20
+	// errors
+	JournalClosed      = "journal is closed"
+	JournalCorrupt     = "journal is corrupt"
+	RecordTooLarge     = "journal record too large"
+	AlreadyJournaled   = "event already journaled"
+	CannotReplayRecord = "cannot replay journal record"
+)
+
+// Selector decides whether a payload is journaled. The key identifies
+// the state the record establishes, compaction only keeps the latest
+// record of every key. Records with an empty key are always kept. A
+// record that removes the state of its key also supersedes the records
+// of the keys below it, e.g. removing "server/main" supersedes
+// "server/main/update", and of the keys whose parent it is, e.g. the
+// networks of the server.
+type Selector func(v interface{}) (key string, parent string, removes bool, ok bool)
+
+// Record is a single journaled event.
+type Record struct {
+	// event the record is replayed as
+	Event string
+	Key   string
+	// key of the state the one of the record belongs to
+	Parent  string `json:",omitempty"`
+	Removes bool   `json:",omitempty"`
+	Time    time.Time
+	Payload json.RawMessage
+}
+
+type selection struct {
+	as string
+	f  Selector
+}
+
+// Journal is an append-only file of selected events. Every record is
+// stored as its length and crc32 followed by the json encoded record.
+type Journal struct {
+	Path string
+	// guards everything below
+	lock          sync.Mutex
+	file          *os.File
+	selected      map[string]*selection
+	subscriptions []*Subscription
+}
+
+func readRecord(r *bufio.Reader) (*Record, int, error) {
+	var h [8]byte
+	if _, e := io.ReadFull(r, h[:]); e != nil {
+		return nil, 0, e
+	}
+	n := binary.BigEndian.Uint32(h[0:4])
+	if n > uint32(MaxRecordSize) {
+		return nil, 0, err.New(RecordTooLarge, strconv.Itoa(int(n)))
+	}
+	b := make([]byte, n)
+	if _, e := io.ReadFull(r, b); e != nil {
+		return nil, 0, e
+	}
+	if crc32.ChecksumIEEE(b) != binary.BigEndian.Uint32(h[4:8]) {
+		return nil, 0, err.New(JournalCorrupt)
+	}
+	rec := &Record{}
+	if e := json.Unmarshal(b, rec); e != nil {
+		return nil, 0, e
+	}
+	return rec, len(h) + len(b), nil
+}
+
+func writeRecord(w io.Writer, rec *Record) error {
+	b, e := json.Marshal(rec)
+	if e != nil {
+		return e
+	}
+	if len(b) > MaxRecordSize {
+		return err.New(RecordTooLarge, strconv.Itoa(len(b)))
+	}
+	var h [8]byte
+	binary.BigEndian.PutUint32(h[0:4], uint32(len(b)))
+	binary.BigEndian.PutUint32(h[4:8], crc32.ChecksumIEEE(b))
+	if _, e := w.Write(h[:]); e != nil {
+		return e
+	}
+	_, e = w.Write(b)
+	return e
+}
+
+// read returns all valid records of the journal file and
+// the offset of the first invalid byte.
+func read(path string) ([]*Record, int64, error) {
+	f, e := os.Open(path)
+	if os.IsNotExist(e) == true {
+		return nil, 0, nil
+	} else if e != nil {
+		return nil, 0, e
+	}
+	defer f.Close()
+	var records []*Record
+	var offset int64
+	r := bufio.NewReader(f)
+	for {
+		rec, n, e := readRecord(r)
+		if e == io.EOF {
+			return records, offset, nil
+		} else if e != nil {
+			debug.Warn("Journal %s: dropping records after offset %d (%s)", path, offset, e.Error())
+			return records, offset, nil
+		}
+		records = append(records, rec)
+		offset += int64(n)
+	}
+}
+
+// compact returns the records without the superseded ones.
+func compact(records []*Record) []*Record {
+	latest := make(map[string]int)
+	// latest removal of every key
+	removed := make(map[string]int)
+	// latest parent of every key
+	parents := make(map[string]string)
+	for i, rec := range records {
+		if rec.Key == "" {
+			continue
+		}
+		latest[rec.Key] = i
+		if rec.Removes == true {
+			removed[rec.Key] = i
+		}
+		if rec.Parent != "" {
+			parents[rec.Key] = rec.Parent
+		}
+	}
+	var r []*Record
+	for i, rec := range records {
+		if rec.Key == "" || (latest[rec.Key] == i && removedLater(removed, parents, rec.Key, i) == false) {
+			r = append(r, rec)
+		}
+	}
+	return r
+}
+
+// removedLater returns whether a key above key or one of its
+// parents was removed after i.
+func removedLater(removed map[string]int, parents map[string]string, key string, i int) bool {
+	// parents of parents, a broken journal might contain a loop
+	seen := make(map[string]bool)
+	for k := key; k != "" && seen[k] == false; k = parents[k] {
+		seen[k] = true
+		for r, j := range removed {
+			if j <= i {
+				continue
+			}
+			if strings.HasPrefix(k, r+"/") == true || (k != key && k == r) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// OpenJournal opens the journal at path, creating it if needed. A
+// corrupt or truncated tail, e.g. from a crash while writing, is cut
+// off, a journal with many superseded records is compacted.
+func OpenJournal(path string) (*Journal, error) {
+	j := &Journal{Path: path, selected: make(map[string]*selection)}
+	records, offset, e := read(path)
+	if e != nil {
+		return nil, e
+	}
+	if len(records)-len(compact(records)) > CompactAfter {
+		if e := j.Compact(); e != nil {
+			return nil, e
+		}
+		return j, nil
+	}
+	f, e := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0600)
+	if e != nil {
+		return nil, e
+	}
+	if e := f.Truncate(offset); e != nil {
+		f.Close()
+		return nil, e
+	}
+	if _, e := f.Seek(offset, io.SeekStart); e != nil {
+		f.Close()
+		return nil, e
+	}
+	j.file = f
+	return j, nil
+}
+
+// Select journals the event s whenever f accepts its payload. The
+// records are replayed as the event as, e.g. so that accepted commands
+// are replayed as commands. Journaling starts with Replay.
+func (j *Journal) Select(s, as string, f Selector) error {
+	j.lock.Lock()
+	defer j.lock.Unlock()
+	if j.selected[s] != nil {
+		return err.New(AlreadyJournaled, s)
+	}
+	j.selected[s] = &selection{as: as, f: f}
+	return nil
+}
+
+// Replay fires all records of the journal in order, each one after the
+// previous is delivered, and then starts journaling the selected events.
+// Must not be called from within a listener or callback.
+func (j *Journal) Replay() (int, error) {
+	records, _, e := read(j.Path)
+	if e != nil {
+		return 0, e
+	}
+	n := 0
+	for _, rec := range records {
+		v, e := Decode(rec.Event, rec.Payload)
+		if e == nil {
+			e = Fire(rec.Event, v)
+		}
+		if e != nil {
+			debug.Warn("%s: %s (%s)", CannotReplayRecord, rec.Event, e.Error())
+			continue
+		}
+		// records depend on their predecessors, e.g. a host
+		// on its network, deliver them one after another
+		Flush()
+		n++
+	}
+	j.lock.Lock()
+	defer j.lock.Unlock()
+	if j.file == nil {
+		return n, err.New(JournalClosed)
+	}
+	for s, sel := range j.selected {
+		sel := sel
+		sub, e := Subscribe(s, func(s string, v interface{}) {
+			j.record(sel, v)
+		})
+		if e != nil {
+			return n, e
+		}
+		j.subscriptions = append(j.subscriptions, sub)
+	}
+	return n, nil
+}
+
+func (j *Journal) record(sel *selection, v interface{}) {
+	key, parent, removes, ok := sel.f(v)
+	if ok == false {
+		return
+	}
+	b, e := json.Marshal(v)
+	if e != nil {
+		debug.Err("Journal %s: cannot record %s (%s)", j.Path, sel.as, e.Error())
+		return
+	}
+	rec := &Record{
+		Event:   sel.as,
+		Key:     key,
+		Parent:  parent,
+		Removes: removes,
+		Time:    time.Now(),
+		Payload: b,
+	}
+	if e := j.Append(rec); e != nil {
+		debug.Err("Journal %s: cannot record %s (%s)", j.Path, sel.as, e.Error())
+	}
+}
+
+// Append writes rec to the journal and syncs it to disk.
+func (j *Journal) Append(rec *Record) error {
+	j.lock.Lock()
+	defer j.lock.Unlock()
+	if j.file == nil {
+		return err.New(JournalClosed)
+	}
+	if e := writeRecord(j.file, rec); e != nil {
+		return e
+	}
+	return j.file.Sync()
+}
+
+// Compact rewrites the journal without superseded and corrupt records.
+func (j *Journal) Compact() error {
+	j.lock.Lock()
+	defer j.lock.Unlock()
+	records, _, e := read(j.Path)
+	if e != nil {
+		return e
+	}
+	records = compact(records)
+	tmp := j.Path + ".tmp"
+	f, e := os.OpenFile(tmp, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0600)
+	if e != nil {
+		return e
+	}
+	w := bufio.NewWriter(f)
+	for _, rec := range records {
+		if e = writeRecord(w, rec); e != nil {
+			break
+		}
+	}
+	if e == nil {
+		e = w.Flush()
+	}
+	if e == nil {
+		e = f.Sync()
+	}
+	if e == nil {
+		e = os.Rename(tmp, j.Path)
+	}
+	if e != nil {
+		f.Close()
+		os.Remove(tmp)
+		return e
+	}
+	if _, e := f.Seek(0, io.SeekEnd); e != nil {
+		f.Close()
+		return e
+	}
+	if j.file != nil {
+		j.file.Close()
+	}
+	j.file = f
+	debug.Info("Journal %s compacted to %d records", j.Path, len(records))
+	return nil
+}
+
+// Close stops journaling and closes the journal file.
+func (j *Journal) Close() error {
+	j.lock.Lock()
+	defer j.lock.Unlock()
+	for _, s := range j.subscriptions {
+		s.Cancel()
+	}
+	j.subscriptions = nil
+	if j.file == nil {
+		return err.New(JournalClosed)
+	}
+	e := j.file.Close()
+	j.file = nil
+	return e
+}
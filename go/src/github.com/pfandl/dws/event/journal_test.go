@@ -0,0 +1,160 @@
+package event
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func records(keys ...string) []*Record {
+	var r []*Record
+	for i, k := range keys {
+		rec := &Record{Event: "test", Key: k, Time: time.Now(), Payload: json.RawMessage(`"` + string(rune('a'+i)) + `"`)}
+		// keys starting with - remove what they name, a parent
+		// follows the key after <
+		if len(k) > 0 && k[0] == '-' {
+			rec.Key = k[1:]
+			rec.Removes = true
+		}
+		rec.Key, rec.Parent, _ = strings.Cut(rec.Key, "<")
+		r = append(r, rec)
+	}
+	return r
+}
+
+func payloads(r []*Record) string {
+	s := ""
+	for _, rec := range r {
+		var p string
+		json.Unmarshal(rec.Payload, &p)
+		s += p
+	}
+	return s
+}
+
+func TestCompact(t *testing.T) {
+	tests := []struct {
+		name string
+		keys []string
+		want string
+	}{
+		{"empty", nil, ""},
+		{"no keys are kept", []string{"", ""}, "ab"},
+		{"latest of a key", []string{"a", "b", "a"}, "bc"},
+		{"update kept apart", []string{"s/m", "s/m/update", "s/m/update"}, "ac"},
+		{"removal supersedes below", []string{"s/m", "s/m/update", "s/n", "-s/m"}, "cd"},
+		{"added again", []string{"s/m", "-s/m", "s/m", "s/m/update"}, "cd"},
+		{"removal does not reach siblings", []string{"s/mm", "-s/m"}, "ab"},
+		{"removal supersedes children", []string{"s/m", "n/x<s/m", "n/x/update<s/m", "n/y<s/o", "-s/m"}, "de"},
+		{"removal supersedes grandchildren", []string{"s/m", "n/x<s/m", "h/a<n/x", "-s/m"}, "d"},
+		{"removal of a child", []string{"s/m", "n/x<s/m", "h/a<n/x", "-n/x"}, "ad"},
+		{"child moved", []string{"n/x<s/m", "-n/x", "n/x<s/o", "-s/m"}, "cd"},
+		{"parent loop", []string{"n/x<n/y", "n/y<n/x", "-s/m"}, "abc"},
+	}
+	for _, tt := range tests {
+		if got := payloads(compact(records(tt.keys...))); got != tt.want {
+			t.Errorf("%s: got %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestJournalTail(t *testing.T) {
+	tests := []struct {
+		name string
+		// damages the journal file of size n
+		damage func(t *testing.T, path string, n int64)
+		want   string
+	}{
+		{"intact", func(t *testing.T, path string, n int64) {}, "abc"},
+		{"truncated tail", func(t *testing.T, path string, n int64) {
+			if e := os.Truncate(path, n-3); e != nil {
+				t.Fatal(e)
+			}
+		}, "ab"},
+		{"crc mismatch", func(t *testing.T, path string, n int64) {
+			f, e := os.OpenFile(path, os.O_RDWR, 0)
+			if e != nil {
+				t.Fatal(e)
+			}
+			defer f.Close()
+			// flip a byte of the last payload
+			if _, e := f.WriteAt([]byte{'x'}, n-3); e != nil {
+				t.Fatal(e)
+			}
+		}, "ab"},
+	}
+	for _, tt := range tests {
+		path := filepath.Join(t.TempDir(), "journal")
+		j, e := OpenJournal(path)
+		if e != nil {
+			t.Fatal(e)
+		}
+		for _, rec := range records("", "", "") {
+			if e := j.Append(rec); e != nil {
+				t.Fatal(e)
+			}
+		}
+		j.Close()
+		fi, e := os.Stat(path)
+		if e != nil {
+			t.Fatal(e)
+		}
+		tt.damage(t, path, fi.Size())
+
+		// the damaged tail is cut off and appended to again
+		j, e = OpenJournal(path)
+		if e != nil {
+			t.Fatalf("%s: %v", tt.name, e)
+		}
+		if e := j.Append(records("", "", "", "")[3]); e != nil {
+			t.Fatal(e)
+		}
+		j.Close()
+		r, _, e := read(path)
+		if e != nil {
+			t.Fatalf("%s: %v", tt.name, e)
+		}
+		if got := payloads(r); got != tt.want+"d" {
+			t.Errorf("%s: got %q, want %q", tt.name, got, tt.want+"d")
+		}
+	}
+}
+
+func TestJournalCompactOnOpen(t *testing.T) {
+	old := CompactAfter
+	CompactAfter = 2
+	defer func() {
+		CompactAfter = old
+	}()
+	path := filepath.Join(t.TempDir(), "journal")
+	j, e := OpenJournal(path)
+	if e != nil {
+		t.Fatal(e)
+	}
+	for _, rec := range records("a", "a", "a", "a", "b") {
+		if e := j.Append(rec); e != nil {
+			t.Fatal(e)
+		}
+	}
+	j.Close()
+	if j, e = OpenJournal(path); e != nil {
+		t.Fatal(e)
+	}
+	defer j.Close()
+	r, _, e := read(path)
+	if e != nil {
+		t.Fatal(e)
+	}
+	if got := payloads(r); got != "de" {
+		t.Errorf("got %q, want %q", got, "de")
+	}
+	if _, e := os.Stat(path + ".tmp"); os.IsNotExist(e) == false {
+		t.Errorf("temporary file left behind")
+	}
+	if r[0].Key != "a" {
+		t.Errorf("got key %q, want a", r[0].Key)
+	}
+}
@@ -0,0 +1,90 @@
+package event
+
+import (
+	"reflect"
+	"sync"
+)
+
+var (
+	// guards queues and everything in them
+	orderLock sync.Mutex
+	queues    = make(map[interface{}]*fifo)
+)
+
+type delivery struct {
+	a *ActiveEvent
+	f func()
+}
+
+// fifo holds the Ordered deliveries of a subscriber, it is served
+// by a goroutine as long as it is not empty.
+type fifo struct {
+	key     interface{}
+	cond    *sync.Cond
+	pending []delivery
+	running bool
+}
+
+// subscriber returns the key of the Ordered queue of l.
+func subscriber(l _passiveEvent) interface{} {
+	if s, ok := l.(HasSubscriber); ok {
+		return s.Subscriber()
+	}
+	if reflect.TypeOf(l).Comparable() == true {
+		return l
+	}
+	return describe(l)
+}
+
+// order queues f of the event a for the subscriber k
+// according to the options o of a.
+func order(k interface{}, a *ActiveEvent, o Options, f func()) {
+	started()
+	orderLock.Lock()
+	defer orderLock.Unlock()
+	for {
+		q := queues[k]
+		if q == nil {
+			q = &fifo{key: k, cond: sync.NewCond(&orderLock)}
+			queues[k] = q
+		}
+		if len(q.pending) == 0 || len(q.pending) < o.Queue {
+			q.pending = append(q.pending, delivery{a: a, f: f})
+			if q.running == false {
+				q.running = true
+				go q.serve()
+			}
+			return
+		}
+		switch o.Policy {
+		case DropNewest:
+			a.dropped.Add(1)
+			finished()
+			return
+		case DropOldest:
+			q.pending[0].a.dropped.Add(1)
+			q.pending = q.pending[1:]
+			finished()
+		default:
+			// the queue might be gone when we wake up, look it up again
+			q.cond.Wait()
+		}
+	}
+}
+
+func (q *fifo) serve() {
+	orderLock.Lock()
+	for len(q.pending) > 0 {
+		d := q.pending[0]
+		q.pending[0] = delivery{}
+		q.pending = q.pending[1:]
+		q.cond.Broadcast()
+		orderLock.Unlock()
+		d.f()
+		finished()
+		orderLock.Lock()
+	}
+	q.running = false
+	delete(queues, q.key)
+	orderLock.Unlock()
+}
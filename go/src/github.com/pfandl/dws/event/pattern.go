@@ -0,0 +1,66 @@
+package event
+
+import (
+	"github.com/pfandl/dws/error"
+	"path"
+	"sync"
+)
+
+var (
+	// errors
+	InvalidPattern = "invalid event pattern"
+
+	patternLock sync.RWMutex
+	patterns    []*Subscription
+)
+
+// IsPattern reports whether s contains wildcards.
+func IsPattern(s string) bool {
+	for _, c := range s {
+		switch c {
+		case '*', '?', '[', '\\':
+			return true
+		}
+	}
+	return false
+}
+
+// SubscribePattern registers c for all events whose names match the
+// pattern p, e.g. "network-*", "*-available" or "*" (see path.Match).
+// Events registered later are matched as well, so p may also be the
+// plain name of an event that does not exist yet.
+func SubscribePattern(p string, c func(string, interface{})) (*Subscription, error) {
+	if _, e := path.Match(p, ""); e != nil {
+		return nil, err.New(InvalidPattern, p)
+	}
+	s := &Subscription{Event: p, callback: &c, pattern: true}
+	patternLock.Lock()
+	patterns = append(patterns, s)
+	patternLock.Unlock()
+	return s, nil
+}
+
+func unsubscribePattern(s *Subscription) error {
+	patternLock.Lock()
+	defer patternLock.Unlock()
+	for i, p := range patterns {
+		if p == s {
+			patterns = append(append([]*Subscription{}, patterns[:i]...), patterns[i+1:]...)
+			return nil
+		}
+	}
+	return err.New(CallbackNotFound, s.Event)
+}
+
+// matching returns the callbacks of all patterns matching the event s.
+func matching(s string) []*func(string, interface{}) {
+	patternLock.RLock()
+	defer patternLock.RUnlock()
+	var c []*func(string, interface{})
+	for _, p := range patterns {
+		if ok, _ := path.Match(p.Event, s); ok == true {
+			c = append(c, p.callback)
+		}
+	}
+	return c
+}
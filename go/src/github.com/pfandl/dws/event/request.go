@@ -0,0 +1,184 @@
+package event
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"github.com/pfandl/dws/error"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	// errors
+	RequestTimeout   = "request timed out"
+	RequestCancelled = "request cancelled"
+	NotCorrelated    = "payload cannot be correlated"
+
+	// pending requests by reply event and correlation id
+	pendingLock sync.Mutex
+	pending     = make(map[string]map[string]*Future)
+	// the reply events we are subscribed to
+	replies = make(map[string]*_reply)
+
+	idPrefix string
+	idNext   atomic.Uint64
+)
+
+func init() {
+	b := make([]byte, 4)
+	rand.Read(b)
+	idPrefix = hex.EncodeToString(b) + "-"
+}
+
+// Correlated payloads can be matched with their replies.
+type Correlated interface {
+	CorrelationId() string
+	SetCorrelationId(string)
+}
+
+// Future resolves once the reply to a request arrived, the
+// request timed out or it was cancelled.
+type Future struct {
+	Id    string
+	reply string
+	once  sync.Once
+	done  chan struct{}
+	lock  sync.Mutex
+	timer *time.Timer
+	value interface{}
+	err   error
+}
+
+type _reply struct {
+	a *ActiveEvent
+	c *func(string, interface{})
+}
+
+// NewId returns an id unique within this process.
+func NewId() string {
+	return idPrefix + strconv.FormatUint(idNext.Add(1), 10)
+}
+
+func (f *Future) resolve(v interface{}, e error) {
+	f.once.Do(func() {
+		pendingLock.Lock()
+		delete(pending[f.reply], f.Id)
+		pendingLock.Unlock()
+		f.lock.Lock()
+		if f.timer != nil {
+			f.timer.Stop()
+		}
+		f.lock.Unlock()
+		f.value = v
+		f.err = e
+		close(f.done)
+	})
+}
+
+// Done is closed when the future is resolved.
+func (f *Future) Done() <-chan struct{} {
+	return f.done
+}
+
+// Wait blocks until the future is resolved and returns
+// the reply payload or why there is none.
+func (f *Future) Wait() (interface{}, error) {
+	<-f.done
+	return f.value, f.err
+}
+
+// Cancel gives up waiting, a late reply is ignored.
+func (f *Future) Cancel() {
+	f.resolve(nil, err.New(RequestCancelled, f.Id))
+}
+
+// reply resolves pending requests with the payload of a reply event.
+func reply(s string, v interface{}) {
+	c, ok := v.(Correlated)
+	if ok == false {
+		return
+	}
+	pendingLock.Lock()
+	f := pending[s][c.CorrelationId()]
+	pendingLock.Unlock()
+	if f != nil {
+		f.resolve(v, nil)
+	}
+}
+
+// subscribe makes sure we listen to the reply event s,
+// must be called with pendingLock held.
+func subscribe(s string) error {
+	a := get(s)
+	if a == nil {
+		return err.New(EventNotFound, s)
+	}
+	// the event might have been registered again since
+	if r := replies[s]; r != nil && r.a == a {
+		return nil
+	}
+	c := reply
+	if e := a.RegisterCallback(&c); e != nil {
+		return e
+	}
+	replies[s] = &_reply{a: a, c: &c}
+	return nil
+}
+
+// Request fires s with v and returns a future that resolves when
+// the event reply is fired with a payload carrying the same
+// correlation id. A timeout of 0 waits until the future is cancelled.
+func Request(s string, v interface{}, reply string, timeout time.Duration) *Future {
+	return RequestContext(Background(), s, v, reply, timeout)
+}
+
+// RequestContext is Request with the deliveries of s getting ctx,
+// the future is cancelled when ctx is done.
+func RequestContext(ctx context.Context, s string, v interface{}, reply string, timeout time.Duration) *Future {
+	f := &Future{reply: reply, done: make(chan struct{})}
+	c, ok := v.(Correlated)
+	if ok == false {
+		f.resolve(nil, err.New(NotCorrelated, s))
+		return f
+	}
+	if c.CorrelationId() == "" {
+		c.SetCorrelationId(NewId())
+	}
+	f.Id = c.CorrelationId()
+
+	pendingLock.Lock()
+	if e := subscribe(reply); e != nil {
+		pendingLock.Unlock()
+		f.resolve(nil, e)
+		return f
+	}
+	if pending[reply] == nil {
+		pending[reply] = make(map[string]*Future)
+	}
+	pending[reply][f.Id] = f
+	pendingLock.Unlock()
+
+	if timeout > 0 {
+		f.lock.Lock()
+		f.timer = time.AfterFunc(timeout, func() {
+			f.resolve(nil, err.New(RequestTimeout, s, f.Id))
+		})
+		f.lock.Unlock()
+	}
+	if ctx.Done() != nil {
+		go func() {
+			select {
+			case <-ctx.Done():
+				f.Cancel()
+			case <-f.done:
+			}
+		}()
+	}
+	if e := FireContext(ctx, s, v); e != nil {
+		f.resolve(nil, e)
+	}
+	return f
+}
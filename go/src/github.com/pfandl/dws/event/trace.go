@@ -0,0 +1,167 @@
+package event
+
+import (
+	"fmt"
+	"github.com/pfandl/dws/debug"
+	"reflect"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	// how many fired events are remembered
+	TraceSize = 256
+	// payload summaries are cut after this many characters
+	TracePayloadSize = 128
+
+	tracing    atomic.Bool
+	traceLock  sync.Mutex
+	traces     []*Trace
+	traceNext  int
+	traceCount uint64
+)
+
+func init() {
+	tracing.Store(true)
+}
+
+// Call is a single delivery of a traced event.
+type Call struct {
+	Subscriber string
+	Start      time.Time
+	End        time.Time
+	Panic      string
+}
+
+// Trace records a fired event and the deliveries it caused.
+type Trace struct {
+	Id      uint64
+	Event   string
+	Payload string
+	Fired   time.Time
+	Calls   []Call
+}
+
+// Running reports whether the call has started but not finished yet.
+func (c *Call) Running() bool {
+	return c.Start.IsZero() == false && c.End.IsZero() == true
+}
+
+func SetTracing(b bool) {
+	tracing.Store(b)
+}
+
+// describe returns a readable name of a listener or callback.
+func describe(v interface{}) string {
+	if s, ok := v.(fmt.Stringer); ok {
+		return s.String()
+	}
+	if reflect.TypeOf(v).Kind() == reflect.Func {
+		if f := runtime.FuncForPC(reflect.ValueOf(v).Pointer()); f != nil {
+			return f.Name()
+		}
+	}
+	return fmt.Sprintf("%T", v)
+}
+
+func summarize(v interface{}) string {
+	s := fmt.Sprintf("%T %+v", v, v)
+	if len(s) > TracePayloadSize {
+		s = s[:TracePayloadSize] + "..."
+	}
+	return s
+}
+
+// trace starts a new trace in the ring buffer,
+// returns nil if tracing is disabled.
+func trace(s string, v interface{}, subscribers []string) *Trace {
+	if tracing.Load() == false || TraceSize <= 0 {
+		return nil
+	}
+	t := &Trace{
+		Event:   s,
+		Payload: summarize(v),
+		Fired:   time.Now(),
+		Calls:   make([]Call, len(subscribers)),
+	}
+	for i, n := range subscribers {
+		t.Calls[i].Subscriber = n
+	}
+	traceLock.Lock()
+	defer traceLock.Unlock()
+	traceCount++
+	t.Id = traceCount
+	if len(traces) != TraceSize {
+		traces = make([]*Trace, TraceSize)
+		traceNext = 0
+	}
+	traces[traceNext] = t
+	traceNext = (traceNext + 1) % TraceSize
+	return t
+}
+
+// call wraps f so that its start, end and panic are
+// recorded as the i-th call of t.
+func (t *Trace) call(i int, f func()) func() {
+	if t == nil {
+		return f
+	}
+	return func() {
+		traceLock.Lock()
+		t.Calls[i].Start = time.Now()
+		traceLock.Unlock()
+		defer func() {
+			r := recover()
+			traceLock.Lock()
+			t.Calls[i].End = time.Now()
+			if r != nil {
+				t.Calls[i].Panic = fmt.Sprint(r)
+			}
+			traceLock.Unlock()
+			if r != nil {
+				panic(r)
+			}
+		}()
+		f()
+	}
+}
+
+// Traces returns a copy of the recorded traces, oldest first.
+func Traces() []Trace {
+	traceLock.Lock()
+	defer traceLock.Unlock()
+	var r []Trace
+	for i := 0; i < len(traces); i++ {
+		t := traces[(traceNext+i)%len(traces)]
+		if t == nil {
+			continue
+		}
+		c := *t
+		c.Calls = append([]Call{}, t.Calls...)
+		r = append(r, c)
+	}
+	return r
+}
+
+// Dump logs all recorded traces.
+func Dump() {
+	now := time.Now()
+	for _, t := range Traces() {
+		debug.Info("event trace %d: %s fired %s ago with %s",
+			t.Id, t.Event, now.Sub(t.Fired), t.Payload)
+		for _, c := range t.Calls {
+			switch {
+			case c.Start.IsZero():
+				debug.Info("    %s queued", c.Subscriber)
+			case c.Running():
+				debug.Info("    %s running for %s", c.Subscriber, now.Sub(c.Start))
+			case c.Panic != "":
+				debug.Info("    %s panicked after %s: %s", c.Subscriber, c.End.Sub(c.Start), c.Panic)
+			default:
+				debug.Info("    %s took %s", c.Subscriber, c.End.Sub(c.Start))
+			}
+		}
+	}
+}
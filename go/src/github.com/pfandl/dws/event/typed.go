@@ -0,0 +1,54 @@
+package event
+
+import (
+	"github.com/pfandl/dws/debug"
+	"github.com/pfandl/dws/error"
+	"reflect"
+)
+
+// Subscription is a callback registered by Subscribe or SubscribePattern.
+type Subscription struct {
+	// event name or pattern
+	Event    string
+	callback *func(string, interface{})
+	pattern  bool
+}
+
+// Cancel removes the subscription from its event.
+func (s *Subscription) Cancel() error {
+	if s.pattern == true {
+		return unsubscribePattern(s)
+	}
+	if a := get(s.Event); a != nil {
+		return a.UnRegisterCallback(s.callback)
+	}
+	return err.New(EventNotFound, s.Event)
+}
+
+// Subscribe registers f for the event s, f receives the payload as T.
+// Fails if the payload type of s cannot be converted to T.
+func Subscribe[T any](s string, f func(string, T)) (*Subscription, error) {
+	a := get(s)
+	if a == nil {
+		return nil, err.New(EventNotFound, s)
+	}
+	t := reflect.TypeOf((*T)(nil)).Elem()
+	if pt := a.PayloadType(); pt != nil && pt.AssignableTo(t) == false {
+		return nil, err.New(PayloadMismatch, s, t.String(), pt.String())
+	}
+	c := func(n string, v interface{}) {
+		var tv T
+		if v != nil {
+			var ok bool
+			if tv, ok = v.(T); ok == false {
+				debug.Err("%s: %s %T", PayloadMismatch, n, v)
+				return
+			}
+		}
+		f(n, tv)
+	}
+	if e := a.RegisterCallback(&c); e != nil {
+		return nil, e
+	}
+	return &Subscription{Event: s, callback: &c}, nil
+}
@@ -0,0 +1,475 @@
+// Package gateway serves the servers, networks, hosts and backing
+// stores of the config as http resources. Every request is turned into
+// a command, the result of the command becomes the response. Events
+// are streamed to clients as json lines.
+package gateway
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/pfandl/dws/communication"
+	"github.com/pfandl/dws/config"
+	"github.com/pfandl/dws/data"
+	"github.com/pfandl/dws/debug"
+	"github.com/pfandl/dws/error"
+	"github.com/pfandl/dws/event"
+	"github.com/pfandl/dws/module"
+	"github.com/pfandl/dws/token"
+	"github.com/pfandl/dws/validation"
+	"io"
+	"net/http"
+	"net/url"
+	"reflect"
+	"strings"
+	"time"
+)
+
+var (
+	// events we fire
+	ActiveEvents = []string{
+		"command",
+	}
+	// events we are interested in
+	PassiveEvents = []string{
+		"gateway-available",
+	}
+	// payloads of the events we fire
+	EventTypes = map[string]reflect.Type{
+		"command": reflect.TypeOf(&data.Message{}),
+	}
+	// how long a request waits for the result of its command
+	Timeout = 30 * time.Second
+	// longest request body accepted
+	MaxBodySize int64 = 1024 * 1024
+	// events queued per stream, further ones are dropped until
+	// the client catches up
+	MaxQueued = 256
+	// streams without events get an empty line this often, so
+	// that proxies and clients do not give up on them
+	KeepAlive = 30 * time.Second
+	// resources by their path and the commands handling them
+	Resources = map[string]Resource{
+		"servers":       {"get-servers", "add-server", "update-server", "remove-server"},
+		"networks":      {"get-networks", "add-network", "update-network", "remove-network"},
+		"hosts":         {"get-hosts", "add-host", "update-host", "remove-host"},
+		"backingstores": {"get-backingstores", "add-backingstore", "update-backingstore", "remove-backingstore"},
+	}
+	// status of failed commands by the error their message starts with
+	Statuses = map[string]int{
+		config.ServerNotFound:              http.StatusNotFound,
+		config.NetworkNotFound:             http.StatusNotFound,
+		config.HostNotFound:                http.StatusNotFound,
+		config.BackingStoreNotFound:        http.StatusNotFound,
+		config.ServerNameAlreadyUsed:       http.StatusConflict,
+		config.NetworkNameAlreadyUsed:      http.StatusConflict,
+		config.HostNameAlreadyUsed:         http.StatusConflict,
+		config.UtsNameAlreadyUsed:          http.StatusConflict,
+		config.BackingStoreNameAlreadyUsed: http.StatusConflict,
+		config.BackingStorePortAlreadyUsed: http.StatusConflict,
+		config.IpV4Overlap:                 http.StatusConflict,
+		config.IpV4AlreadyUsed:             http.StatusConflict,
+		config.InvalidPayload:              http.StatusBadRequest,
+		config.InvalidNetworkType:          http.StatusBadRequest,
+		config.IpV4Unavailable:             http.StatusBadRequest,
+		config.WrongSubnet:                 http.StatusBadRequest,
+		config.TlsNeedsCertAndKey:          http.StatusBadRequest,
+		validation.Failed:                  http.StatusBadRequest,
+		validation.Invalid:                 http.StatusBadRequest,
+		validation.InvalidValue:            http.StatusBadRequest,
+		config.TokensNotConfigured:         http.StatusNotFound,
+		config.InvalidTokenValidity:        http.StatusBadRequest,
+		token.TokenNotFound:                http.StatusNotFound,
+		token.TokenNameAlreadyUsed:         http.StatusConflict,
+		token.TokenNeedsName:               http.StatusBadRequest,
+		token.TokenNeedsPermission:         http.StatusBadRequest,
+		module.UnknownPermission:           http.StatusBadRequest,
+		event.RequestTimeout:               http.StatusGatewayTimeout,
+		event.HandlerTimeout:               http.StatusGatewayTimeout,
+	}
+	// errors
+	NameMismatch = "name of path and body differ"
+	BodyTooLarge = "request body too large"
+	NeedsEvents  = "stream needs at least one event"
+	CannotStream = "connection cannot be streamed"
+)
+
+// Resource names the commands getting, adding, updating and
+// removing a kind of resource.
+type Resource struct {
+	Get    string
+	Add    string
+	Update string
+	Remove string
+}
+
+type Gateways struct {
+	module.Module
+	Configs []*config.Gateway
+	servers []*http.Server
+}
+
+func (c *Gateways) Name() string {
+	return "gateway"
+}
+
+func (c *Gateways) Dependencies() []string {
+	return []string{"config"}
+}
+
+func (c *Gateways) Events(active bool) []string {
+	debug.Ver("Gateways: Events %v", active)
+	if active == true {
+		return ActiveEvents
+	} else {
+		return PassiveEvents
+	}
+}
+
+func (c *Gateways) EventTypes() map[string]reflect.Type {
+	return EventTypes
+}
+
+func (c *Gateways) Event(e string, v interface{}) {
+	debug.Ver("Gateways got event: %s %v", e, v)
+	switch e {
+	case "gateway-available":
+		c.Available(v.(*config.Gateway))
+	default:
+		debug.Err("Gateways event %s unknown", e)
+	}
+}
+
+func (c *Gateways) Init() error {
+	debug.Ver("Gateways Init()")
+	return nil
+}
+
+func (c *Gateways) Start() error {
+	debug.Ver("Gateways Start()")
+	for _, g := range c.Configs {
+		t, e := g.Tls.ListenConfig()
+		if e != nil {
+			c.stop()
+			return e
+		}
+		l, e := communication.Listen(g.IpV4.Address+":"+g.IpV4.Port, t)
+		if e != nil {
+			c.stop()
+			return e
+		}
+		s := &http.Server{
+			Handler:           Handler(),
+			ReadHeaderTimeout: Timeout,
+		}
+		c.servers = append(c.servers, s)
+		go func(g *config.Gateway) {
+			if e := s.Serve(l); e != nil && e != http.ErrServerClosed {
+				debug.Err("Gateway %s failed %s", g.Name, e.Error())
+			}
+		}(g)
+	}
+	return nil
+}
+
+func (c *Gateways) stop() {
+	for _, s := range c.servers {
+		s.Close()
+	}
+	c.servers = nil
+}
+
+func (c *Gateways) Stop() error {
+	debug.Ver("Gateways Stop()")
+	c.stop()
+	return nil
+}
+
+func (c *Gateways) Available(g *config.Gateway) {
+	debug.Ver("Gateways available: %v", g)
+	c.Configs = append(c.Configs, g)
+}
+
+// Handler returns the handler serving all resources. Collections are
+// listed with GET and added to with POST, a single resource is read
+// with GET, replaced with PUT and removed with DELETE. Any command can
+// be run by posting its payload to /commands/{command}. Events are
+// streamed from /events, see stream. If tokens are configured every
+// request needs one as bearer of its Authorization header.
+func Handler() http.Handler {
+	return http.HandlerFunc(serve)
+}
+
+func serve(w http.ResponseWriter, q *http.Request) {
+	debug.Ver("Gateway %s %s", q.Method, q.URL.Path)
+	p := strings.Split(strings.Trim(q.URL.Path, "/"), "/")
+	if len(p) > 2 || (len(p) == 2 && p[1] == "") {
+		http.NotFound(w, q)
+		return
+	}
+	if p[0] == "events" && len(p) == 1 {
+		if q.Method != http.MethodGet {
+			notAllowed(w, http.MethodGet)
+			return
+		}
+		stream(w, q)
+		return
+	}
+	if p[0] == "commands" && len(p) == 2 {
+		if q.Method != http.MethodPost {
+			notAllowed(w, http.MethodPost)
+			return
+		}
+		if b, ok := body(w, q); ok == true {
+			execute(w, q, p[1], b, http.StatusOK)
+		}
+		return
+	}
+	r, ok := Resources[p[0]]
+	if ok == false {
+		http.NotFound(w, q)
+		return
+	}
+	if len(p) == 1 {
+		collection(w, q, r)
+	} else {
+		item(w, q, r, p[1])
+	}
+}
+
+func collection(w http.ResponseWriter, q *http.Request, r Resource) {
+	switch q.Method {
+	case http.MethodGet:
+		execute(w, q, r.Get, nil, http.StatusOK)
+	case http.MethodPost:
+		if b, ok := body(w, q); ok == true {
+			execute(w, q, r.Add, b, http.StatusCreated)
+		}
+	default:
+		notAllowed(w, http.MethodGet, http.MethodPost)
+	}
+}
+
+func item(w http.ResponseWriter, q *http.Request, r Resource, n string) {
+	switch q.Method {
+	case http.MethodGet:
+		execute(w, q, r.Get, name(n), http.StatusOK)
+	case http.MethodPut:
+		b, ok := body(w, q)
+		if ok == false {
+			return
+		}
+		if b, ok = rename(w, b, n); ok == false {
+			return
+		}
+		execute(w, q, r.Update, b, http.StatusOK)
+	case http.MethodDelete:
+		execute(w, q, r.Remove, name(n), http.StatusNoContent)
+	default:
+		notAllowed(w, http.MethodGet, http.MethodPut, http.MethodDelete)
+	}
+}
+
+func notAllowed(w http.ResponseWriter, m ...string) {
+	w.Header().Set("Allow", strings.Join(m, ", "))
+	http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+}
+
+// stream writes the events selected by the query as json lines until
+// the client goes away. Every event parameter is an event name or
+// pattern, all other parameters are fields the payload must have, e.g.
+// /events?event=module-*&State=failed.
+func stream(w http.ResponseWriter, q *http.Request) {
+	f, ok := w.(http.Flusher)
+	if ok == false {
+		fail(w, http.StatusInternalServerError, &data.Error{Code: data.CodeFailed, Message: CannotStream})
+		return
+	}
+	ctx, e := module.Authorize(q.Context(), bearer(q))
+	if e != nil {
+		fail(w, http.StatusUnauthorized, &data.Error{Code: data.CodeUnauthorized, Message: e.Error()})
+		return
+	}
+	// streaming events needs the same as reading them
+	read := module.Command{Permissions: []module.Permission{module.Read}}
+	if p, ok := module.PermissionsOf(ctx); ok == true && read.Permits(p) == false {
+		fail(w, http.StatusForbidden, &data.Error{Code: data.CodeForbidden, Message: module.PermissionDenied})
+		return
+	}
+	v := q.URL.Query()
+	if len(v["event"]) == 0 {
+		fail(w, http.StatusBadRequest, &data.Error{Code: data.CodeInvalidPayload, Message: NeedsEvents})
+		return
+	}
+	match := make(map[string]string)
+	for k, s := range v {
+		if k != "event" {
+			match[k] = s[0]
+		}
+	}
+	out := make(chan []byte, MaxQueued)
+	var subs []*event.Subscription
+	defer func() {
+		for _, sub := range subs {
+			sub.Cancel()
+		}
+	}()
+	for _, p := range v["event"] {
+		sub, e := event.SubscribePattern(p, func(s string, x interface{}) {
+			if data.IsPrivate(x) == true || module.MaySee(ctx, s) == false {
+				return
+			}
+			env, e := data.Push(s, x)
+			if e != nil {
+				debug.Warn("Gateway cannot push %s (%s)", s, e.Error())
+				return
+			}
+			if env.Matches(match) == false {
+				return
+			}
+			select {
+			case out <- env.ToJson():
+			default:
+				debug.Warn("Gateway dropping %s for %s", s, q.RemoteAddr)
+			}
+		})
+		if e != nil {
+			fail(w, http.StatusBadRequest, &data.Error{Code: data.CodeInvalidPayload, Message: e.Error()})
+			return
+		}
+		subs = append(subs, sub)
+	}
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	f.Flush()
+	t := time.NewTicker(KeepAlive)
+	defer t.Stop()
+	for {
+		var b []byte
+		select {
+		case b = <-out:
+		case <-t.C:
+			// revoked or expired tokens end the stream
+			if _, e := module.Authorize(q.Context(), bearer(q)); e != nil {
+				return
+			}
+		case <-q.Context().Done():
+			return
+		}
+		if _, e := w.Write(append(b, '\n')); e != nil {
+			return
+		}
+		f.Flush()
+	}
+}
+
+// bearer returns the token of the authorization header of q.
+func bearer(q *http.Request) string {
+	h := q.Header.Get("Authorization")
+	if len(h) > 7 && strings.EqualFold(h[:7], "bearer ") {
+		return strings.TrimSpace(h[7:])
+	}
+	return ""
+}
+
+// name returns the name n as payload.
+func name(n string) []byte {
+	b, _ := json.Marshal(n)
+	return b
+}
+
+func body(w http.ResponseWriter, q *http.Request) ([]byte, bool) {
+	b, e := io.ReadAll(http.MaxBytesReader(w, q.Body, MaxBodySize))
+	var me *http.MaxBytesError
+	if errors.As(e, &me) == true {
+		fail(w, http.StatusRequestEntityTooLarge, &data.Error{Code: data.CodeInvalidPayload, Message: BodyTooLarge})
+		return nil, false
+	} else if e != nil {
+		fail(w, http.StatusBadRequest, &data.Error{Code: data.CodeInvalidPayload, Message: e.Error()})
+		return nil, false
+	}
+	return b, true
+}
+
+// rename sets the name of the resource b to the one of the
+// path, a resource cannot be renamed.
+func rename(w http.ResponseWriter, b []byte, n string) ([]byte, bool) {
+	var r map[string]interface{}
+	if e := json.Unmarshal(b, &r); e != nil || r == nil {
+		fail(w, http.StatusBadRequest, &data.Error{Code: data.CodeInvalidPayload, Message: config.InvalidPayload})
+		return nil, false
+	}
+	if s, ok := r["Name"]; ok == true && s != n {
+		fail(w, http.StatusBadRequest, &data.Error{Code: data.CodeInvalidPayload, Message: err.New(NameMismatch, n).Error()})
+		return nil, false
+	}
+	r["Name"] = n
+	b, _ = json.Marshal(r)
+	return b, true
+}
+
+// execute runs the command s and writes its result, with the
+// status ok if it succeeded.
+func execute(w http.ResponseWriter, q *http.Request, s string, b []byte, ok int) {
+	env := &data.Envelope{
+		Version: data.Version,
+		Id:      event.NewId(),
+		Command: s,
+		Payload: b,
+		Token:   bearer(q),
+	}
+	r := module.Execute(q.Context(), env, Timeout)
+	if r.Error != nil {
+		fail(w, status(r.Error), r.Error)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if ok == http.StatusNoContent {
+		w.WriteHeader(ok)
+		return
+	}
+	if ok == http.StatusCreated {
+		var n struct {
+			Name string
+		}
+		json.Unmarshal(r.Payload, &n)
+		w.Header().Set("Location", strings.TrimSuffix(q.URL.Path, "/")+"/"+url.PathEscape(n.Name))
+	}
+	w.WriteHeader(ok)
+	if len(r.Payload) > 0 {
+		w.Write(r.Payload)
+	} else {
+		b, _ := json.Marshal(map[string]string{"Message": r.Message})
+		w.Write(b)
+	}
+}
+
+// status returns the status of a request failing with e.
+func status(e *data.Error) int {
+	switch e.Code {
+	case data.CodeInvalidEnvelope, data.CodeInvalidPayload:
+		return http.StatusBadRequest
+	case data.CodeUnknownCommand:
+		return http.StatusNotFound
+	case data.CodeUnauthorized:
+		return http.StatusUnauthorized
+	case data.CodeForbidden:
+		return http.StatusForbidden
+	case data.CodeUnavailable:
+		return http.StatusServiceUnavailable
+	}
+	if s, ok := Statuses[strings.Split(e.Message, " | ")[0]]; ok == true {
+		return s
+	}
+	return http.StatusInternalServerError
+}
+
+func fail(w http.ResponseWriter, s int, e *data.Error) {
+	if s == http.StatusUnauthorized {
+		w.Header().Set("WWW-Authenticate", "Bearer")
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(s)
+	b, _ := json.Marshal(e)
+	w.Write(b)
+}
@@ -0,0 +1,382 @@
+package module
+
+import (
+	"context"
+	"fmt"
+	"github.com/pfandl/dws/data"
+	"github.com/pfandl/dws/debug"
+	"github.com/pfandl/dws/error"
+	"github.com/pfandl/dws/event"
+	"reflect"
+	rdebug "runtime/debug"
+	"sort"
+	"sync"
+	"time"
+)
+
+type Permission string
+
+const (
+	// looking at the state of the daemon
+	Read Permission = "read"
+	// changing servers, networks and hosts
+	Write Permission = "write"
+	// controlling the daemon and its modules
+	Admin Permission = "admin"
+)
+
+var (
+	// errors
+	CommandAlreadyRegistered = "command already registered"
+	UnknownCommand           = "unknown command"
+	UnknownPermission        = "unknown permission"
+	PermissionDenied         = "permission denied"
+	CommandPanicked          = "command handler panicked"
+	CommandQuarantined       = "command quarantined after repeated failures"
+	// messages
+	CommandList = "available commands"
+
+	// guards commands
+	commandLock sync.RWMutex
+	commands    = make(map[string]*Command)
+	// guards failures
+	failureLock sync.Mutex
+	// panics of handlers by command, see dispatch
+	failures = make(map[string]*event.Failure)
+)
+
+// rank orders permissions, holding one includes the lower ones.
+var rank = map[Permission]int{
+	Read:  1,
+	Write: 2,
+	Admin: 3,
+}
+
+// ParsePermission returns the permission named s.
+func ParsePermission(s string) (Permission, error) {
+	p := Permission(s)
+	if rank[p] == 0 {
+		return "", err.New(UnknownPermission, s)
+	}
+	return p, nil
+}
+
+// Handler handles a command, it has to fire command-result with m
+// once it is done, this may also be done by another module.
+type Handler func(ctx context.Context, m *data.Message)
+
+// Command is an entry of the command registry.
+type Command struct {
+	Name string
+	// module handling the command
+	Module string
+	// modules that have to run as well for the command to work
+	Requires    []string `json:",omitempty"`
+	Permissions []Permission
+	Help        string
+	// payload type, nil if the command takes none
+	Type    reflect.Type `json:"-"`
+	Handler Handler      `json:"-"`
+	// schema of the payload, see Schema
+	Arguments interface{} `json:",omitempty"`
+}
+
+func init() {
+	for _, c := range []Command{
+		{
+			Name:        "module-status",
+			Permissions: []Permission{Read},
+			Help:        "reports the state of the daemon and all modules",
+			Handler:     moduleStatus,
+		},
+		{
+			Name:        "event-trace",
+			Permissions: []Permission{Read},
+			Help:        "returns the most recently fired events and their deliveries",
+			Handler:     eventTrace,
+		},
+		{
+			Name:        "list-commands",
+			Permissions: []Permission{Read},
+			Help:        "lists all commands with their permissions and arguments",
+			Handler:     listCommands,
+		},
+		{
+			Name:        "start-module",
+			Type:        reflect.TypeOf(""),
+			Permissions: []Permission{Admin},
+			Help:        "starts the module named by the payload",
+			Handler:     lifecycle(Start, ModuleStarted),
+		},
+		{
+			Name:        "stop-module",
+			Type:        reflect.TypeOf(""),
+			Permissions: []Permission{Admin},
+			Help:        "stops the module named by the payload",
+			Handler:     lifecycle(Stop, ModuleStopped),
+		},
+		{
+			Name:        "restart-module",
+			Type:        reflect.TypeOf(""),
+			Permissions: []Permission{Admin},
+			Help:        "restarts the module named by the payload",
+			Handler:     lifecycle(Restart, ModuleRestarted),
+		},
+	} {
+		if e := RegisterCommand("module", c); e != nil {
+			debug.Fat(e.Error())
+		}
+	}
+}
+
+// RegisterCommand adds the command c of the module m to the registry.
+// A command without handler only makes the command depend on m, the
+// module registering it with a handler handles it.
+func RegisterCommand(m string, c Command) error {
+	commandLock.Lock()
+	defer commandLock.Unlock()
+	old := commands[c.Name]
+	if c.Handler == nil {
+		if old == nil {
+			old = &Command{Name: c.Name}
+			commands[c.Name] = old
+		}
+		old.Requires = append(old.Requires, m)
+		return nil
+	}
+	if old != nil && old.Handler != nil {
+		return err.New(CommandAlreadyRegistered, c.Name, old.Module)
+	}
+	c.Module = m
+	if old != nil {
+		c.Requires = append(c.Requires, old.Requires...)
+	}
+	commands[c.Name] = &c
+	return nil
+}
+
+// UnRegisterCommands removes all commands of the module m.
+func UnRegisterCommands(m string) {
+	commandLock.Lock()
+	defer commandLock.Unlock()
+	for n, c := range commands {
+		if c.Module == m {
+			// modules requiring the command keep their entry
+			c.Module = ""
+			c.Handler = nil
+		}
+		for i := 0; i < len(c.Requires); i++ {
+			if c.Requires[i] == m {
+				c.Requires = append(append([]string{}, c.Requires[:i]...), c.Requires[i+1:]...)
+				i--
+			}
+		}
+		if c.Handler == nil && len(c.Requires) == 0 {
+			delete(commands, n)
+		}
+	}
+}
+
+// Lookup returns the registry entry of the command s.
+func Lookup(s string) (Command, bool) {
+	commandLock.RLock()
+	defer commandLock.RUnlock()
+	c := commands[s]
+	if c == nil || c.Handler == nil {
+		return Command{}, false
+	}
+	r := *c
+	r.Requires = append([]string{}, c.Requires...)
+	return r, true
+}
+
+// Commands returns all commands that can be handled sorted
+// by name, their arguments are filled in.
+func Commands() []Command {
+	commandLock.RLock()
+	var r []Command
+	for _, c := range commands {
+		if c.Handler == nil {
+			continue
+		}
+		cc := *c
+		cc.Requires = append([]string{}, c.Requires...)
+		r = append(r, cc)
+	}
+	commandLock.RUnlock()
+	sort.Slice(r, func(i, j int) bool {
+		return r[i].Name < r[j].Name
+	})
+	for i := range r {
+		if r[i].Type != nil {
+			r[i].Arguments = Schema(r[i].Type)
+		}
+	}
+	return r
+}
+
+// Permits reports whether a caller holding the permissions p may run
+// c, Admin includes Write and Write includes Read.
+func (c Command) Permits(p []Permission) bool {
+	held := 0
+	for _, h := range p {
+		if rank[h] > held {
+			held = rank[h]
+		}
+	}
+	for _, r := range c.Permissions {
+		if rank[r] > held {
+			return false
+		}
+	}
+	return true
+}
+
+// CommandType returns the payload type of the command s, nil
+// if the command takes no payload or is unknown.
+func CommandType(s string) reflect.Type {
+	c, _ := Lookup(s)
+	return c.Type
+}
+
+// Available returns an error if the command s is unknown or
+// a module needed for it is not running.
+func Available(s string) error {
+	c, ok := Lookup(s)
+	if ok == false {
+		return err.New(UnknownCommand, s)
+	}
+	for _, n := range append([]string{c.Module}, c.Requires...) {
+		// commands of the module package itself
+		m := lookup(n)
+		if m == nil {
+			continue
+		}
+		if m.Running() == false {
+			return err.New(ModuleUnavailable, n, s)
+		}
+	}
+	return nil
+}
+
+// fail answers m with the error e.
+func fail(m *data.Message, e error) {
+	m.Succeeded = false
+	m.Message = e.Error()
+	event.Fire("command-result", m)
+}
+
+// dispatch hands the command m to its handler. Whether the modules
+// are running is checked by whoever accepts commands from clients,
+// replaying the journal happens before they are started. A handler
+// that panics is answered for, once it panicked too often its command
+// is quarantined until the module handling it is started again.
+func dispatch(ctx context.Context, m *data.Message) {
+	debug.Ver("Module: dispatching command %v", m)
+	c, ok := Lookup(m.Message)
+	if ok == false {
+		fail(m, err.New(UnknownCommand, m.Message))
+		return
+	}
+	if isQuarantined(c.Name) == true {
+		fail(m, err.New(CommandQuarantined, c.Name))
+		return
+	}
+	defer func() {
+		if r := recover(); r != nil {
+			failed(c, r)
+			fail(m, err.New(CommandPanicked, c.Name, fmt.Sprint(r)))
+		}
+	}()
+	c.Handler(ctx, m)
+}
+
+// failed counts the panic r of the handler of c and reports it.
+func failed(c Command, r interface{}) {
+	failureLock.Lock()
+	fl := &event.Failure{
+		Event:      "command",
+		Subscriber: c.Module + " " + c.Name,
+		Panic:      fmt.Sprint(r),
+		Stack:      string(rdebug.Stack()),
+		Time:       time.Now(),
+		Failures:   1,
+	}
+	if old := failures[c.Name]; old != nil && fl.Time.Sub(old.Time) < event.FailureWindow {
+		fl.Failures = old.Failures + 1
+		// keep the time of the first failure in the window
+		fl.Time = old.Time
+	}
+	// commands of our own have no module that could be restarted
+	fl.Quarantined = fl.Failures >= event.MaxFailures && c.Module != "module"
+	failures[c.Name] = fl
+	report := *fl
+	failureLock.Unlock()
+
+	debug.Err("Module: command %s panicked (%s)", c.Name, report.Panic)
+	if report.Quarantined == true {
+		debug.Err("Module: command %s quarantined after %d failures", c.Name, report.Failures)
+	}
+	event.Fire(event.ErrorEvent, &report)
+}
+
+func isQuarantined(s string) bool {
+	failureLock.Lock()
+	defer failureLock.Unlock()
+	return failures[s] != nil && failures[s].Quarantined == true
+}
+
+// releaseCommands forgets the failures of the commands of the module m.
+func releaseCommands(m string) {
+	failureLock.Lock()
+	defer failureLock.Unlock()
+	for n := range failures {
+		if c, ok := Lookup(n); ok == false || c.Module == m {
+			delete(failures, n)
+		}
+	}
+}
+
+func moduleStatus(ctx context.Context, m *data.Message) {
+	Check()
+	m.Data = Report{
+		Daemon:  Mode(),
+		Modules: GetStatus(),
+	}
+	m.Message = ModuleStatus
+	m.Succeeded = true
+	event.Fire("command-result", m)
+}
+
+func eventTrace(ctx context.Context, m *data.Message) {
+	m.Data = event.Traces()
+	m.Message = EventTrace
+	m.Succeeded = true
+	event.Fire("command-result", m)
+}
+
+func listCommands(ctx context.Context, m *data.Message) {
+	m.Data = Commands()
+	m.Message = CommandList
+	m.Succeeded = true
+	event.Fire("command-result", m)
+}
+
+// lifecycle returns a handler calling f with the module
+// name passed as payload, answering r on success.
+func lifecycle(f func(string) error, r string) Handler {
+	return func(ctx context.Context, m *data.Message) {
+		s, _ := m.Data.(string)
+		if e := f(s); e != nil {
+			m.Succeeded = false
+			m.Message = e.Error()
+		} else {
+			m.Succeeded = true
+			m.Message = r
+		}
+		if mm := lookup(s); mm != nil {
+			m.Data = mm.Status()
+		}
+		event.Fire("command-result", m)
+	}
+}
@@ -0,0 +1,59 @@
+package module
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestPermits(t *testing.T) {
+	tests := []struct {
+		needs  []Permission
+		held   []Permission
+		permit bool
+	}{
+		{nil, nil, true},
+		{[]Permission{Read}, nil, false},
+		{[]Permission{Read}, []Permission{Read}, true},
+		{[]Permission{Read}, []Permission{Write}, true},
+		{[]Permission{Read}, []Permission{Admin}, true},
+		{[]Permission{Write}, []Permission{Read}, false},
+		{[]Permission{Write}, []Permission{Read, Write}, true},
+		{[]Permission{Admin}, []Permission{Write}, false},
+		{[]Permission{Admin}, []Permission{Read, Admin}, true},
+		{[]Permission{Read, Write}, []Permission{Read}, false},
+		// unknown permissions grant nothing
+		{[]Permission{Read}, []Permission{"root"}, false},
+	}
+	for _, tt := range tests {
+		c := Command{Name: "test", Permissions: tt.needs}
+		if p := c.Permits(tt.held); p != tt.permit {
+			t.Errorf("%v holding %v: got %v, want %v", tt.needs, tt.held, p, tt.permit)
+		}
+	}
+}
+
+func TestParsePermission(t *testing.T) {
+	tests := []struct {
+		s   string
+		p   Permission
+		err string
+	}{
+		{"read", Read, ""},
+		{"write", Write, ""},
+		{"admin", Admin, ""},
+		{"Admin", "", UnknownPermission},
+		{"", "", UnknownPermission},
+	}
+	for _, tt := range tests {
+		p, e := ParsePermission(tt.s)
+		if tt.err != "" {
+			if e == nil || strings.HasPrefix(e.Error(), tt.err) == false {
+				t.Errorf("%q: got %v, want %s", tt.s, e, tt.err)
+			}
+			continue
+		}
+		if e != nil || p != tt.p {
+			t.Errorf("%q: got %s %v, want %s", tt.s, p, e, tt.p)
+		}
+	}
+}
@@ -0,0 +1,336 @@
+package module
+
+import (
+	"context"
+	"github.com/pfandl/dws/data"
+	"github.com/pfandl/dws/debug"
+	"github.com/pfandl/dws/error"
+	"github.com/pfandl/dws/event"
+	"reflect"
+	"sync"
+)
+
+var (
+	// errors
+	ModuleRunning    = "module is already running"
+	ModuleNotRunning = "module is not running"
+	ModuleInUse      = "module is required by running module"
+	ModuleNameNeeded = "command needs a module name"
+	// messages
+	EventTrace      = "event trace"
+	ModuleStarted   = "module was started"
+	ModuleStopped   = "module was stopped"
+	ModuleRestarted = "module was restarted"
+
+	// serializes starting and stopping of modules between
+	// commands, the supervisor and StartAll/StopAll
+	control sync.Mutex
+	// guards controlled and loaded
+	pending sync.Mutex
+	// set while control is held
+	controlled bool
+	// modules loaded while control was held, started once it is released
+	loaded []string
+	// our own subscriptions to commands
+	commanders []*commander
+)
+
+// listener delivers one passive event to a module. Every
+// registration gets its own listener so it can be removed again.
+type listener struct {
+	m *_module
+	e string
+}
+
+func (l *listener) Extinguish(v interface{}) {
+	l.m.m.Event(l.e, v)
+}
+
+func (l *listener) ExtinguishContext(ctx context.Context, v interface{}) {
+	if c, ok := l.m.m.(IsContextEventListener); ok == true {
+		c.EventContext(ctx, l.e, v)
+		return
+	}
+	l.m.m.Event(l.e, v)
+}
+
+func (l *listener) String() string {
+	return l.m.m.Name()
+}
+
+// all events of a module share its Ordered queue
+func (l *listener) Subscriber() string {
+	return l.m.m.Name()
+}
+
+// commander hands commands to their handlers in the registry.
+type commander struct {
+	e string
+}
+
+func (c *commander) Extinguish(v interface{}) {
+	dispatch(event.Background(), v.(*data.Message))
+}
+
+func (c *commander) ExtinguishContext(ctx context.Context, v interface{}) {
+	dispatch(ctx, v.(*data.Message))
+}
+
+func (c *commander) String() string {
+	return "module"
+}
+
+func (c *commander) Subscriber() string {
+	return "module"
+}
+
+// failures of handlers are counted per command by dispatch
+func (c *commander) Dispatcher() {}
+
+func (m *_module) Running() bool {
+	switch m.Get() {
+	case Started, Degraded:
+		return true
+	}
+	return false
+}
+
+// register registers the active events of m and
+// subscribes m to its passive events.
+func (m *_module) register() error {
+	n := m.m.Name()
+	debug.Ver("Module: registering events for %s", n)
+	var types map[string]reflect.Type
+	if t, ok := m.m.(HasEventTypes); ok {
+		types = t.EventTypes()
+	}
+	for _, e := range m.m.Events(true) {
+		if _, err := event.RegisterEvent(e, types[e]); err != nil {
+			return err
+		}
+		debug.Ver("Module: registered event %s for %s", e, n)
+	}
+	for _, e := range m.m.Events(false) {
+		if event.IsPattern(e) == true {
+			s, err := event.SubscribePattern(e, m.m.Event)
+			if err != nil {
+				return err
+			}
+			m.subscriptions = append(m.subscriptions, s)
+			debug.Ver("Module: subscribed %s to %s", n, e)
+			continue
+		}
+		// the module firing this event might not be loaded yet
+		if _, err := event.RegisterEvent(e); err != nil {
+			return err
+		}
+		l := &listener{m: m, e: e}
+		if err := event.RegisterListener(e, l); err != nil {
+			return err
+		}
+		m.listeners = append(m.listeners, l)
+		debug.Ver("Module: registered listener %s for %s", e, n)
+	}
+	return nil
+}
+
+// unregister removes all subscriptions of m. Active events are kept
+// as other modules might still be listening to them.
+func (m *_module) unregister() {
+	for _, l := range m.listeners {
+		event.UnRegisterListener(l.e, l)
+	}
+	m.listeners = nil
+	for _, s := range m.subscriptions {
+		s.Cancel()
+	}
+	m.subscriptions = nil
+}
+
+func (m *_module) init() error {
+	if e := failedDependency(m); e != nil {
+		m.Set(Failed, e)
+		return e
+	}
+	debug.Ver("Module: initializing %s", m.m.Name())
+	if e := m.m.Init(); e != nil {
+		m.Set(Failed, e)
+		return e
+	}
+	m.initialized = true
+	m.Set(Initialized, nil)
+	return nil
+}
+
+func (m *_module) start() error {
+	if e := failedDependency(m); e != nil {
+		m.Set(Failed, e)
+		return e
+	}
+	debug.Ver("Module: starting %s", m.m.Name())
+	if e := m.m.Start(); e != nil {
+		m.Set(Failed, e)
+		return e
+	}
+	// a (re)started module gets the events and commands it was
+	// quarantined for again
+	for _, e := range m.m.Events(false) {
+		event.Release(e, m.m.Name())
+	}
+	releaseCommands(m.m.Name())
+	m.Set(Started, nil)
+	return nil
+}
+
+// Start subscribes m to its events and brings it up,
+// initializing it first if that never succeeded.
+func (m *_module) Start() error {
+	if m.Running() == true {
+		return err.New(ModuleRunning, m.m.Name())
+	}
+	m.unregister()
+	if e := m.register(); e != nil {
+		m.unregister()
+		m.Set(Failed, e)
+		return e
+	}
+	// no flushing of events here, we might be called from
+	// within an event and would wait for ourselves
+	if m.initialized == false {
+		if e := m.init(); e != nil {
+			return e
+		}
+	}
+	return m.start()
+}
+
+// Stop stops m and removes its subscriptions.
+func (m *_module) Stop() error {
+	debug.Ver("Module: stopping %s", m.m.Name())
+	e := m.m.Stop()
+	m.unregister()
+	m.Set(Stopped, e)
+	return e
+}
+
+// Restart stops a running module and brings it back up.
+func (m *_module) Restart() error {
+	if m.Running() == true {
+		if e := m.Stop(); e != nil {
+			debug.Warn("Module: stopping %s failed (%s)", m.m.Name(), e.Error())
+		}
+	}
+	return m.Start()
+}
+
+func find(s string) (*_module, error) {
+	if s == "" {
+		return nil, err.New(ModuleNameNeeded)
+	}
+	m := lookup(s)
+	if m == nil {
+		return nil, err.New(ModuleNotFound, s)
+	}
+	return m, nil
+}
+
+func lockControl() {
+	control.Lock()
+	pending.Lock()
+	controlled = true
+	pending.Unlock()
+}
+
+// unlockControl releases control and starts the modules
+// loaded in the meantime.
+func unlockControl() {
+	pending.Lock()
+	controlled = false
+	l := loaded
+	loaded = nil
+	pending.Unlock()
+	control.Unlock()
+	for _, s := range l {
+		if e := Start(s); e != nil {
+			debug.Err("Module: cannot start loaded %s (%s)", s, e.Error())
+		}
+	}
+}
+
+// Load registers m and starts it, for modules that are only known
+// at runtime. If m is loaded while another module is started, e.g.
+// by that module, m is started once that is done.
+func Load(m Module, r ...Requirement) error {
+	if e := Register(m, r...); e != nil {
+		return e
+	}
+	pending.Lock()
+	if controlled == true {
+		loaded = append(loaded, m.Name())
+		pending.Unlock()
+		return nil
+	}
+	pending.Unlock()
+	return Start(m.Name())
+}
+
+// Fail marks the running module s as failed, e.g. if it noticed
+// it cannot continue on its own. The supervisor takes it from there.
+func Fail(s string, e error) {
+	if m := lookup(s); m != nil && m.Running() == true {
+		debug.Err("Module: %s failed (%s)", s, e.Error())
+		m.Set(Failed, e)
+	}
+}
+
+// Start starts the stopped or failed module s.
+func Start(s string) error {
+	lockControl()
+	defer unlockControl()
+	m, e := find(s)
+	if e != nil {
+		return e
+	}
+	// a manual start gives the supervisor a fresh budget
+	m.retries = 0
+	m.gaveUp = false
+	return m.Start()
+}
+
+// Stop stops the running module s unless a running module needs it.
+func Stop(s string) error {
+	lockControl()
+	defer unlockControl()
+	m, e := find(s)
+	if e != nil {
+		return e
+	}
+	if m.Running() == false {
+		return err.New(ModuleNotRunning, s)
+	}
+	// also optional ones, their dependents would be left without them
+	for _, d := range registered() {
+		if d.Running() == false {
+			continue
+		}
+		for _, dd := range d.Dependencies() {
+			if dd == s {
+				return err.New(ModuleInUse, s, d.m.Name())
+			}
+		}
+	}
+	return m.Stop()
+}
+
+// Restart stops the module s if it is running and starts it again.
+func Restart(s string) error {
+	lockControl()
+	defer unlockControl()
+	m, e := find(s)
+	if e != nil {
+		return e
+	}
+	m.retries = 0
+	m.gaveUp = false
+	return m.Restart()
+}
@@ -0,0 +1,106 @@
+package module
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+type testModule struct {
+	name string
+	// loaded by Start if set
+	load Module
+}
+
+func (t *testModule) Name() string                  { return t.name }
+func (t *testModule) Events(active bool) []string   { return nil }
+func (t *testModule) Event(e string, v interface{}) {}
+func (t *testModule) Init() error                   { return nil }
+func (t *testModule) Stop() error                   { return nil }
+
+func (t *testModule) Start() error {
+	if t.load != nil {
+		if _, e := Get(t.load.Name()); e != nil {
+			return Load(t.load, Optional)
+		}
+	}
+	return nil
+}
+
+func TestLoadWhileStarting(t *testing.T) {
+	child := &testModule{name: "test-child"}
+	parent := &testModule{name: "test-parent", load: child}
+	if e := Register(parent, Optional); e != nil {
+		t.Fatal(e)
+	}
+	defer UnRegister(parent)
+	defer UnRegister(child)
+
+	tests := []struct {
+		name string
+		f    func(string) error
+	}{
+		{"start", Start},
+		{"restart", Restart},
+	}
+	for _, tt := range tests {
+		if tt.name == "restart" {
+			// loaded again by the restarted parent
+			if e := Stop(child.name); e != nil {
+				t.Fatal(e)
+			}
+			UnRegister(child)
+		}
+		done := make(chan error, 1)
+		go func() {
+			done <- tt.f(parent.name)
+		}()
+		select {
+		case e := <-done:
+			if e != nil {
+				t.Fatalf("%s: %v", tt.name, e)
+			}
+		case <-time.After(3 * time.Second):
+			t.Fatalf("%s: deadlocked", tt.name)
+		}
+		if m := lookup(child.name); m == nil || m.Running() == false {
+			t.Errorf("%s: loaded module is not running", tt.name)
+		}
+	}
+}
+
+func TestStopInUse(t *testing.T) {
+	for _, r := range []Requirement{Required, Optional} {
+		dep := &orderModule{name: "test-dependency"}
+		user := &orderModule{name: "test-user", deps: []string{dep.name}}
+		if e := Register(dep, r); e != nil {
+			t.Fatal(e)
+		}
+		if e := Register(user, Optional); e != nil {
+			t.Fatal(e)
+		}
+		tests := []struct {
+			name string
+			f    func(string) error
+			s    string
+			err  string
+		}{
+			{"start dependency", Start, dep.name, ""},
+			{"start user", Start, user.name, ""},
+			{"stop dependency", Stop, dep.name, ModuleInUse},
+			{"stop user", Stop, user.name, ""},
+			{"stop unused dependency", Stop, dep.name, ""},
+		}
+		for _, tt := range tests {
+			e := tt.f(tt.s)
+			if tt.err == "" && e != nil {
+				t.Errorf("%v %s: %v", r, tt.name, e)
+			}
+			if tt.err != "" && (e == nil || strings.HasPrefix(e.Error(), tt.err) == false) {
+				t.Errorf("%v %s: got %v, want %s", r, tt.name, e, tt.err)
+			}
+		}
+		UnRegister(user)
+		UnRegister(dep)
+	}
+}
@@ -0,0 +1,139 @@
+package module
+
+import (
+	"context"
+	"github.com/pfandl/dws/data"
+	"github.com/pfandl/dws/event"
+	"sync"
+	"time"
+)
+
+// Authenticator returns the permissions granted by a token.
+type Authenticator func(token string) ([]Permission, error)
+
+var (
+	// guards authenticator
+	authenticatorLock sync.Mutex
+	authenticator     Authenticator
+)
+
+// SetAuthenticator makes every request executed without permissions
+// authenticate with its token, nil lets them through unrestricted.
+func SetAuthenticator(a Authenticator) {
+	authenticatorLock.Lock()
+	authenticator = a
+	authenticatorLock.Unlock()
+}
+
+// Authorize returns ctx carrying the permissions granted by the token
+// and the token itself, ctx if it already carries permissions or no
+// authenticator is set.
+func Authorize(ctx context.Context, token string) (context.Context, error) {
+	if _, ok := PermissionsOf(ctx); ok == true {
+		return ctx, nil
+	}
+	authenticatorLock.Lock()
+	a := authenticator
+	authenticatorLock.Unlock()
+	if a == nil {
+		return ctx, nil
+	}
+	p, e := a(token)
+	if e != nil {
+		return nil, e
+	}
+	return WithPermissions(context.WithValue(ctx, tokenKey{}, token), p), nil
+}
+
+// commands of other callers and their results, pushed to admins only
+var confidential = map[string]bool{
+	"command":        true,
+	"check-command":  true,
+	"command-result": true,
+}
+
+// MaySee reports whether the caller of ctx may be pushed the event s.
+// Callers without admin permission see neither the commands of others
+// nor their results.
+func MaySee(ctx context.Context, s string) bool {
+	if confidential[s] == false {
+		return true
+	}
+	p, ok := PermissionsOf(ctx)
+	if ok == false {
+		return true
+	}
+	admin := Command{Permissions: []Permission{Admin}}
+	return admin.Permits(p)
+}
+
+// tokenKey carries the token a caller was authorized with.
+type tokenKey struct{}
+
+// Valid reports whether the token ctx was authorized with is still
+// accepted, callers that are kept around have to check it again as
+// tokens are revoked and expire.
+func Valid(ctx context.Context) bool {
+	token, ok := ctx.Value(tokenKey{}).(string)
+	if ok == false {
+		return true
+	}
+	authenticatorLock.Lock()
+	a := authenticator
+	authenticatorLock.Unlock()
+	if a == nil {
+		return true
+	}
+	_, e := a(token)
+	return e == nil
+}
+
+// permissionsKey carries the permissions of a caller, commands
+// executed without are not restricted.
+type permissionsKey struct{}
+
+// WithPermissions returns a copy of ctx allowing the commands
+// executed with it only what p permits.
+func WithPermissions(ctx context.Context, p []Permission) context.Context {
+	return context.WithValue(ctx, permissionsKey{}, p)
+}
+
+// PermissionsOf returns the permissions ctx carries and
+// whether it carries any.
+func PermissionsOf(ctx context.Context) ([]Permission, bool) {
+	p, ok := ctx.Value(permissionsKey{}).([]Permission)
+	return p, ok
+}
+
+// Execute fires the command of the request env and returns the answer
+// to it, waiting at most timeout. Handling is cancelled with ctx.
+func Execute(ctx context.Context, env *data.Envelope, timeout time.Duration) *data.Envelope {
+	ctx, err := Authorize(ctx, env.Token)
+	if err != nil {
+		return env.Reply(&data.Error{Code: data.CodeUnauthorized, Message: err.Error()})
+	}
+	c, ok := Lookup(env.Command)
+	if ok == false {
+		return env.Reply(&data.Error{Code: data.CodeUnknownCommand, Message: UnknownCommand})
+	}
+	if p, ok := PermissionsOf(ctx); ok == true && c.Permits(p) == false {
+		return env.Reply(&data.Error{Code: data.CodeForbidden, Message: PermissionDenied})
+	}
+	// do not wait for modules that cannot answer
+	if e := Available(env.Command); e != nil {
+		return env.Reply(&data.Error{Code: data.CodeUnavailable, Message: e.Error()})
+	}
+	m, e := env.Decode(c.Type)
+	if e != nil {
+		return env.Reply(e)
+	}
+
+	// every request gets its own id, the client's one is
+	// only used for the reply
+	m.Id = event.NewId()
+	r, err := event.RequestContext(ctx, "command", m, "command-result", timeout).Wait()
+	if err != nil {
+		return env.Reply(&data.Error{Code: data.CodeFailed, Message: err.Error()})
+	}
+	return env.Result(r.(*data.Message))
+}
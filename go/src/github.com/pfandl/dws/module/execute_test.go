@@ -0,0 +1,222 @@
+package module
+
+import (
+	"context"
+	"errors"
+	"github.com/pfandl/dws/data"
+	"github.com/pfandl/dws/event"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func execute(t *testing.T, s string) *data.Envelope {
+	t.Helper()
+	env := &data.Envelope{Version: data.Version, Id: s, Command: s}
+	done := make(chan *data.Envelope, 1)
+	go func() {
+		done <- Execute(context.Background(), env, 5*time.Second)
+	}()
+	select {
+	case r := <-done:
+		return r
+	case <-time.After(3 * time.Second):
+		t.Fatalf("%s was not answered", s)
+	}
+	return nil
+}
+
+func TestPanickingCommand(t *testing.T) {
+	if e := RegisterCommand("test", Command{
+		Name: "test-panic",
+		Handler: func(ctx context.Context, m *data.Message) {
+			panic("boom")
+		},
+	}); e != nil {
+		t.Fatal(e)
+	}
+	defer UnRegisterCommands("test")
+	if e := StartAll(); e != nil {
+		t.Fatal(e)
+	}
+	defer StopAll()
+
+	tests := []struct {
+		command string
+		code    string
+		message string
+	}{
+		{"test-panic", data.CodeFailed, CommandPanicked},
+		{"list-commands", "", ""},
+		{"test-panic", data.CodeFailed, CommandPanicked},
+		{"test-panic", data.CodeFailed, CommandPanicked},
+		// the command failed too often, the others keep working
+		{"test-panic", data.CodeFailed, CommandQuarantined},
+		{"list-commands", "", ""},
+		{"module-status", "", ""},
+	}
+	for i, tt := range tests {
+		r := execute(t, tt.command)
+		if tt.code == "" {
+			if r.Error != nil {
+				t.Errorf("%d %s: unexpected error %v", i, tt.command, r.Error)
+			}
+			continue
+		}
+		if r.Error == nil || r.Error.Code != tt.code || strings.HasPrefix(r.Error.Message, tt.message) == false {
+			t.Errorf("%d %s: got %v, want %s %s", i, tt.command, r.Error, tt.code, tt.message)
+		}
+	}
+	if q := event.Quarantined("command"); len(q) != 0 {
+		t.Errorf("command event quarantined: %v", q)
+	}
+
+	releaseCommands("test")
+	if r := execute(t, "test-panic"); r.Error == nil || strings.HasPrefix(r.Error.Message, CommandPanicked) == false {
+		t.Errorf("released command: got %v", r.Error)
+	}
+}
+
+func TestValid(t *testing.T) {
+	tokens := map[string]bool{"a": true, "b": true}
+	SetAuthenticator(func(token string) ([]Permission, error) {
+		if tokens[token] == false {
+			return nil, errors.New("invalid")
+		}
+		return []Permission{Read}, nil
+	})
+	defer SetAuthenticator(nil)
+
+	a, e := Authorize(context.Background(), "a")
+	if e != nil {
+		t.Fatal(e)
+	}
+	b, e := Authorize(context.Background(), "b")
+	if e != nil {
+		t.Fatal(e)
+	}
+	// callers of the socket carry permissions but no token
+	s, _ := Authorize(WithPermissions(context.Background(), []Permission{Read}), "")
+	delete(tokens, "b")
+
+	tests := []struct {
+		name  string
+		ctx   context.Context
+		valid bool
+	}{
+		{"token", a, true},
+		{"revoked token", b, false},
+		{"no token", s, true},
+		{"not authorized", context.Background(), true},
+	}
+	for _, tt := range tests {
+		if v := Valid(tt.ctx); v != tt.valid {
+			t.Errorf("%s: got %v, want %v", tt.name, v, tt.valid)
+		}
+	}
+}
+
+func TestMaySee(t *testing.T) {
+	read := WithPermissions(context.Background(), []Permission{Read})
+	admin := WithPermissions(context.Background(), []Permission{Admin})
+	tests := []struct {
+		name  string
+		ctx   context.Context
+		event string
+		want  bool
+	}{
+		{"reader", read, "server-available", true},
+		{"reader", read, "command", false},
+		{"reader", read, "check-command", false},
+		{"reader", read, "command-result", false},
+		{"admin", admin, "command-result", true},
+		{"not authorized", context.Background(), "command-result", true},
+	}
+	for _, tt := range tests {
+		if got := MaySee(tt.ctx, tt.event); got != tt.want {
+			t.Errorf("%s %s: got %v, want %v", tt.name, tt.event, got, tt.want)
+		}
+	}
+}
+
+func TestExecute(t *testing.T) {
+	echo := func(ctx context.Context, m *data.Message) {
+		m.Succeeded = true
+		m.Message = "done"
+		event.Fire("command-result", m)
+	}
+	for _, c := range []Command{
+		{Name: "test-write", Permissions: []Permission{Write}, Type: reflect.TypeOf(0), Handler: echo},
+		{Name: "test-read", Permissions: []Permission{Read}, Handler: echo},
+	} {
+		if e := RegisterCommand("test", c); e != nil {
+			t.Fatal(e)
+		}
+	}
+	defer UnRegisterCommands("test")
+	// a module that is registered but not running
+	stopped := &orderModule{name: "test-stopped"}
+	if e := Register(stopped, Optional); e != nil {
+		t.Fatal(e)
+	}
+	defer UnRegister(stopped)
+	if e := RegisterCommand("test-stopped", Command{Name: "test-stopped", Handler: echo}); e != nil {
+		t.Fatal(e)
+	}
+	if e := StartAll(); e != nil {
+		t.Fatal(e)
+	}
+	defer StopAll()
+	if e := Stop(stopped.name); e != nil {
+		t.Fatal(e)
+	}
+	SetAuthenticator(func(token string) ([]Permission, error) {
+		if token != "secret" {
+			return nil, errors.New("invalid")
+		}
+		return []Permission{Read}, nil
+	})
+	defer SetAuthenticator(nil)
+
+	admin := WithPermissions(context.Background(), []Permission{Admin})
+	read := WithPermissions(context.Background(), []Permission{Read})
+	tests := []struct {
+		name    string
+		ctx     context.Context
+		command string
+		token   string
+		payload string
+		code    string
+	}{
+		{"success", admin, "test-write", "", "1", ""},
+		{"enough permissions", read, "test-read", "", "", ""},
+		{"too little permissions", read, "test-write", "", "1", data.CodeForbidden},
+		{"token", context.Background(), "test-read", "secret", "", ""},
+		{"no token", context.Background(), "test-read", "", "", data.CodeUnauthorized},
+		{"invalid token", context.Background(), "test-read", "guess", "", data.CodeUnauthorized},
+		{"too little permissions of token", context.Background(), "test-write", "secret", "1", data.CodeForbidden},
+		{"unknown command", admin, "test-unknown", "", "", data.CodeUnknownCommand},
+		{"invalid payload", admin, "test-write", "", `"one"`, data.CodeInvalidPayload},
+		{"module not running", admin, "test-stopped", "", "", data.CodeUnavailable},
+	}
+	for _, tt := range tests {
+		env := &data.Envelope{Version: data.Version, Id: tt.name, Command: tt.command, Token: tt.token}
+		if tt.payload != "" {
+			env.Payload = []byte(tt.payload)
+		}
+		r := Execute(tt.ctx, env, 3*time.Second)
+		if r.Id != tt.name {
+			t.Errorf("%s: answered with id %s", tt.name, r.Id)
+		}
+		if tt.code == "" {
+			if r.Error != nil || r.Message != "done" {
+				t.Errorf("%s: got %v %s", tt.name, r.Error, r.Message)
+			}
+			continue
+		}
+		if r.Error == nil || r.Error.Code != tt.code {
+			t.Errorf("%s: got %v, want %s", tt.name, r.Error, tt.code)
+		}
+	}
+}
@@ -1,17 +1,42 @@
 package module
 
 import (
+	"context"
 	"github.com/pfandl/dws/debug"
 	"github.com/pfandl/dws/error"
 	"github.com/pfandl/dws/event"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"time"
 )
 
 var (
 	Modules = make(map[string]*_module)
+	// guards Modules, plugins register while commands look up
+	registry sync.RWMutex
+	// replayed by StartAll, see SetJournal
+	journal *event.Journal
+	// how long a module may take to handle a command
+	CommandTimeout = 30 * time.Second
 
 	ModuleNameEmpty         = "module name must not be empty"
 	ModuleAlreadyRegistered = "module already registered"
 	ModuleNotFound          = "module not found"
+	DependencyNotFound      = "module dependency not found"
+	DependencyCycle         = "module dependency cycle"
+	DependencyFailed        = "module dependency failed"
+	ModuleUnavailable       = "module unavailable"
+)
+
+type Requirement int
+
+const (
+	// the daemon cannot run without this module
+	Required Requirement = iota
+	// the daemon keeps running in degraded mode without this module
+	Optional
 )
 
 type HasName interface {
@@ -22,10 +47,31 @@ type HasEvents interface {
 	Events(active bool) []string
 }
 
+type HasDependencies interface {
+	Dependencies() []string
+}
+
+type HasEventTypes interface {
+	EventTypes() map[string]reflect.Type
+}
+
+// HasCommands modules add their commands to the registry
+// when they are registered.
+type HasCommands interface {
+	Commands() []Command
+}
+
 type IsEventListener interface {
 	Event(string, interface{})
 }
 
+// IsContextEventListener modules get EventContext instead of Event, the
+// context is done when the event timed out, the client that caused it
+// went away or the daemon is stopping.
+type IsContextEventListener interface {
+	EventContext(context.Context, string, interface{})
+}
+
 type IsInitiable interface {
 	Init() error
 }
@@ -48,23 +94,70 @@ type Module interface {
 }
 
 type _module struct {
+	_state
+	_supervision
+	listeners      []*listener
+	subscriptions  []*event.Subscription
 	m              Module
+	Requirement    Requirement
 	CanHaveAnError error
 }
 
+func (m *_module) Dependencies() []string {
+	if d, ok := m.m.(HasDependencies); ok {
+		return d.Dependencies()
+	}
+	return nil
+}
+
+// lookup returns the registered module s or nil.
+func lookup(s string) *_module {
+	registry.RLock()
+	defer registry.RUnlock()
+	return Modules[s]
+}
+
+// registered returns all registered modules in no particular order.
+func registered() []*_module {
+	registry.RLock()
+	defer registry.RUnlock()
+	var l []*_module
+	for _, m := range Modules {
+		l = append(l, m)
+	}
+	return l
+}
+
 func Get(s string) (Module, error) {
-	if Modules[s] != nil {
-		return Modules[s].m, nil
+	if m := lookup(s); m != nil {
+		return m.m, nil
 	}
 	return nil, err.New(ModuleNotFound, s)
 }
 
-func Register(m Module) error {
+// Register adds m to the known modules. Modules are required
+// unless Optional is passed.
+func Register(m Module, r ...Requirement) error {
 	debug.Ver("Module: Register()")
 	s := m.Name()
 	debug.Ver("Module: registering %s", s)
+	registry.Lock()
+	defer registry.Unlock()
 	if Modules[s] == nil {
+		// commands stay known while the module is stopped
+		if c, ok := m.(HasCommands); ok == true {
+			for _, cc := range c.Commands() {
+				if e := RegisterCommand(s, cc); e != nil {
+					UnRegisterCommands(s)
+					return e
+				}
+			}
+		}
 		Modules[s] = &_module{m: m}
+		for _, r := range r {
+			Modules[s].Requirement = r
+		}
+		Modules[s].Set(Registered, nil)
 		return nil
 	}
 	return err.New(ModuleAlreadyRegistered, s)
@@ -72,75 +165,192 @@ func Register(m Module) error {
 
 func UnRegister(m Module) error {
 	s := m.Name()
+	registry.Lock()
+	defer registry.Unlock()
 	if Modules[s] != nil {
 		delete(Modules, s)
+		UnRegisterCommands(s)
 		return nil
 	}
 	return err.New(ModuleNotFound, s)
 }
 
 func GetError(s string) error {
-	if Modules[s] != nil {
-		return Modules[s].CanHaveAnError
+	if m := lookup(s); m != nil {
+		return m.CanHaveAnError
 	}
 	return err.New(ModuleNotFound, s)
 }
 
-func StartAll() error {
-	debug.Ver("Module: InitAll()")
-	// active events
-	for _, m := range Modules {
-		n := m.m.Name()
-		debug.Ver("Module: registering events for %s", n)
-		for _, e := range m.m.Events(true) {
-			debug.Ver("Module: registering event %s", e)
-			if _, err := event.RegisterEvent(e); err != nil {
-				return err
+// Order returns all registered modules sorted so that every module
+// comes after the modules it depends on.
+func Order() ([]*_module, error) {
+	// sort names first, so that independent modules always
+	// come up in the same order
+	registry.RLock()
+	defer registry.RUnlock()
+	var names []string
+	for n := range Modules {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+
+	var ordered []*_module
+	visited := make(map[string]bool)
+	// modules currently on the path, used to detect cycles
+	var path []string
+
+	var visit func(n string) error
+	visit = func(n string) error {
+		if visited[n] == true {
+			return nil
+		}
+		for i, p := range path {
+			if p == n {
+				c := append(append([]string{}, path[i:]...), n)
+				return err.New(DependencyCycle, strings.Join(c, " -> "))
 			}
-			debug.Ver("Module: registered event %s for %s", e, n)
 		}
-	}
-	// passive events
-	for _, m := range Modules {
-		n := m.m.Name()
-		debug.Ver("Module: registering callbacks for %s %v", n, m)
-		for _, e := range m.m.Events(false) {
-			debug.Ver("Module: registering callback %s", e)
-			if err := event.RegisterCallback(e, m.m.Event); err != nil {
+		path = append(path, n)
+		for _, d := range Modules[n].Dependencies() {
+			if Modules[d] == nil {
+				return err.New(DependencyNotFound, d, "required by "+n)
+			}
+			if err := visit(d); err != nil {
 				return err
 			}
-			debug.Ver("Module: registered callback %s for %s", e, n)
 		}
+		path = path[:len(path)-1]
+		visited[n] = true
+		ordered = append(ordered, Modules[n])
+		return nil
 	}
-	// init
-	for _, m := range Modules {
-		m.CanHaveAnError = m.m.Init()
+
+	for _, n := range names {
+		if err := visit(n); err != nil {
+			return nil, err
+		}
 	}
-	// finish all outstanding asynchronous events
-	event.Flush()
-	// start
-	for _, m := range Modules {
-		if m.CanHaveAnError == nil {
-			m.CanHaveAnError = m.m.Start()
+	return ordered, nil
+}
+
+// failedDependency returns the first required dependency of m
+// that could not be initialized or started. Failing optional
+// dependencies are tolerated.
+func failedDependency(m *_module) error {
+	for _, d := range m.Dependencies() {
+		if dd := lookup(d); dd != nil && dd.Requirement == Required && dd.Get() == Failed {
+			return err.New(DependencyFailed, d, "required by "+m.m.Name())
 		}
 	}
 	return nil
 }
 
+// SetJournal makes StartAll replay j after all modules are
+// initialized and before any of them is started. StopAll closes j.
+func SetJournal(j *event.Journal) {
+	journal = j
+}
+
+func StartAll() error {
+	debug.Ver("Module: StartAll()")
+	ordered, e := Order()
+	if e != nil {
+		return e
+	}
+	// no locking of control here, modules may load
+	// other modules while they are started
+	for _, m := range ordered {
+		if err := m.register(); err != nil {
+			return err
+		}
+	}
+	// our own commands
+	for _, e := range ActiveEvents {
+		if _, err := event.RegisterEvent(e, EventTypes[e]); err != nil {
+			return err
+		}
+	}
+	for _, e := range PassiveEvents {
+		// commands might be fired by a module registered later
+		if _, err := event.RegisterEvent(e, EventTypes[e]); err != nil {
+			return err
+		}
+		c := &commander{e: e}
+		if err := event.RegisterListener(e, c); err != nil {
+			return err
+		}
+		commanders = append(commanders, c)
+	}
+	// init, dependencies first
+	for _, m := range ordered {
+		m.init()
+		// finish all outstanding asynchronous events, so that
+		// e.g. the config is propagated before the next init
+		event.Flush()
+	}
+	// rebuild the runtime state of the initialized modules
+	// before they start and accept new commands
+	if journal != nil {
+		n, e := journal.Replay()
+		if e != nil {
+			return e
+		}
+		debug.Info("Module: replayed %d journal records", n)
+	}
+	// start, dependencies first
+	for _, m := range ordered {
+		if m.Get() == Failed {
+			continue
+		}
+		m.start()
+		event.Flush()
+	}
+	return nil
+}
+
+func init() {
+	o := event.DefaultOptions
+	o.Timeout = CommandTimeout
+	if e := event.Configure("command", o); e != nil {
+		debug.Fat(e.Error())
+	}
+}
+
 func StopAll() {
-	for _, m := range Modules {
-		m.CanHaveAnError = m.m.Stop()
+	// no restarts while we are going down
+	stopSupervisor()
+	// abandon everything still being handled
+	event.Shutdown()
+	ordered, e := Order()
+	if e != nil {
+		// we still have to stop everything, even
+		// if dependencies are broken
+		debug.Warn("Module: stopping in undefined order (%s)", e.Error())
+		ordered = registered()
 	}
-	// passive events
-	for _, m := range Modules {
-		for _, e := range m.m.Events(false) {
-			event.UnRegisterCallback(e, m.m.Event)
+	lockControl()
+	defer unlockControl()
+	// stop, dependants first
+	for i := len(ordered) - 1; i >= 0; i-- {
+		ordered[i].Stop()
+	}
+	for _, c := range commanders {
+		event.UnRegisterListener(c.e, c)
+	}
+	commanders = nil
+	// all events are gone now
+	for _, m := range ordered {
+		for _, e := range append(m.m.Events(true), m.m.Events(false)...) {
+			if event.IsPattern(e) == false {
+				event.UnRegisterEvent(e)
+			}
 		}
 	}
-	// active events
-	for _, m := range Modules {
-		for _, e := range m.m.Events(true) {
-			event.UnRegisterEvent(e)
+	if journal != nil {
+		if e := journal.Close(); e != nil {
+			debug.Warn("Module: cannot close journal (%s)", e.Error())
 		}
+		journal = nil
 	}
 }
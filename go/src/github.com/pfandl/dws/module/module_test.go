@@ -0,0 +1,94 @@
+package module
+
+import (
+	"strings"
+	"testing"
+)
+
+type orderModule struct {
+	name string
+	deps []string
+}
+
+func (o *orderModule) Name() string                  { return o.name }
+func (o *orderModule) Dependencies() []string        { return o.deps }
+func (o *orderModule) Events(active bool) []string   { return nil }
+func (o *orderModule) Event(e string, v interface{}) {}
+func (o *orderModule) Init() error                   { return nil }
+func (o *orderModule) Start() error                  { return nil }
+func (o *orderModule) Stop() error                   { return nil }
+
+func TestOrder(t *testing.T) {
+	tests := []struct {
+		name    string
+		modules map[string][]string
+		order   []string
+		err     string
+		path    string
+	}{
+		{
+			name:    "chain",
+			modules: map[string][]string{"test-a": {"test-b"}, "test-b": {"test-c"}, "test-c": nil},
+			order:   []string{"test-c", "test-b", "test-a"},
+		},
+		{
+			name:    "independent",
+			modules: map[string][]string{"test-y": nil, "test-x": nil},
+			order:   []string{"test-x", "test-y"},
+		},
+		{
+			name:    "shared dependency",
+			modules: map[string][]string{"test-a": {"test-c"}, "test-b": {"test-c"}, "test-c": nil},
+			order:   []string{"test-c", "test-a", "test-b"},
+		},
+		{
+			name:    "cycle",
+			modules: map[string][]string{"test-a": {"test-b"}, "test-b": {"test-a"}},
+			err:     DependencyCycle,
+			path:    "test-a -> test-b -> test-a",
+		},
+		{
+			name:    "self",
+			modules: map[string][]string{"test-a": {"test-a"}},
+			err:     DependencyCycle,
+			path:    "test-a -> test-a",
+		},
+		{
+			name:    "missing",
+			modules: map[string][]string{"test-a": {"test-missing"}},
+			err:     DependencyNotFound,
+			path:    "test-missing",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for n, d := range tt.modules {
+				m := &orderModule{name: n, deps: d}
+				if e := Register(m); e != nil {
+					t.Fatal(e)
+				}
+				defer UnRegister(m)
+			}
+			ordered, e := Order()
+			if tt.err != "" {
+				if e == nil || strings.HasPrefix(e.Error(), tt.err) == false || strings.Contains(e.Error(), tt.path) == false {
+					t.Fatalf("got %v, want %s %s", e, tt.err, tt.path)
+				}
+				return
+			}
+			if e != nil {
+				t.Fatal(e)
+			}
+			var got []string
+			// modules of other tests might be registered as well
+			for _, m := range ordered {
+				if _, ok := tt.modules[m.m.Name()]; ok == true {
+					got = append(got, m.m.Name())
+				}
+			}
+			if strings.Join(got, " ") != strings.Join(tt.order, " ") {
+				t.Errorf("got order %v, want %v", got, tt.order)
+			}
+		})
+	}
+}
@@ -0,0 +1,82 @@
+package module
+
+import (
+	"encoding/xml"
+	"reflect"
+	"strings"
+)
+
+var (
+	xmlName = reflect.TypeOf(xml.Name{})
+)
+
+// Schema describes the json encoding of values of type t in the
+// style of json schema, so clients know what to send as payload.
+func Schema(t reflect.Type) map[string]interface{} {
+	return schema(t, make(map[reflect.Type]bool))
+}
+
+func schema(t reflect.Type, seen map[reflect.Type]bool) map[string]interface{} {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	switch t.Kind() {
+	case reflect.Bool:
+		return map[string]interface{}{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return map[string]interface{}{"type": "integer"}
+	case reflect.Float32, reflect.Float64:
+		return map[string]interface{}{"type": "number"}
+	case reflect.String:
+		return map[string]interface{}{"type": "string"}
+	case reflect.Slice, reflect.Array:
+		return map[string]interface{}{"type": "array", "items": schema(t.Elem(), seen)}
+	case reflect.Map:
+		return map[string]interface{}{"type": "object", "additionalProperties": schema(t.Elem(), seen)}
+	case reflect.Struct:
+		if seen[t] == true {
+			// recursive types are described once
+			return map[string]interface{}{"type": "object"}
+		}
+		seen[t] = true
+		defer delete(seen, t)
+		p := make(map[string]interface{})
+		properties(t, p, seen)
+		return map[string]interface{}{"type": "object", "properties": p}
+	}
+	// anything goes
+	return map[string]interface{}{}
+}
+
+// properties adds the json fields of the struct t to p, fields
+// of embedded structs are shadowed by fields of t itself.
+func properties(t reflect.Type, p map[string]interface{}, seen map[reflect.Type]bool) {
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		_, tagged := f.Tag.Lookup("json")
+		if f.Anonymous == true && tagged == false && f.Type.Kind() == reflect.Struct {
+			properties(f.Type, p, seen)
+		}
+	}
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		// interfaces embedded for documentation carry no data
+		if f.IsExported() == false || f.Type == xmlName || f.Type.Kind() == reflect.Interface && f.Anonymous == true {
+			continue
+		}
+		name := f.Name
+		if tag, ok := f.Tag.Lookup("json"); ok == true {
+			n := strings.Split(tag, ",")[0]
+			if n == "-" {
+				continue
+			}
+			if n != "" {
+				name = n
+			}
+		} else if f.Anonymous == true && f.Type.Kind() == reflect.Struct {
+			continue
+		}
+		p[name] = schema(f.Type, seen)
+	}
+}
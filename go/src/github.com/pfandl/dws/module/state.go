@@ -0,0 +1,197 @@
+package module
+
+import (
+	"github.com/pfandl/dws/data"
+	"github.com/pfandl/dws/debug"
+	"github.com/pfandl/dws/event"
+	"reflect"
+	"sort"
+	"sync"
+	"time"
+)
+
+type State int
+
+const (
+	Registered State = iota
+	Initialized
+	Started
+	Degraded
+	Failed
+	Stopped
+)
+
+var (
+	// human readable states, also used on the wire
+	States = map[State]string{
+		Registered:  "registered",
+		Initialized: "initialized",
+		Started:     "started",
+		Degraded:    "degraded",
+		Failed:      "failed",
+		Stopped:     "stopped",
+	}
+	// events we fire
+	ActiveEvents = []string{
+		"command-result",
+		// events fired by the supervisor
+		"module-restarting",
+		"module-gave-up",
+		// fired whenever a module changes its state
+		"module-state-changed",
+	}
+	// events we are interested in
+	PassiveEvents = []string{
+		"command",
+	}
+	// payloads of the events above
+	EventTypes = map[string]reflect.Type{
+		"command-result":       reflect.TypeOf(&data.Message{}),
+		"module-restarting":    reflect.TypeOf(Status{}),
+		"module-gave-up":       reflect.TypeOf(Status{}),
+		"module-state-changed": reflect.TypeOf(Status{}),
+		"command":              reflect.TypeOf(&data.Message{}),
+	}
+	// messages
+	ModuleStatus = "module status"
+)
+
+type IsHealthy interface {
+	Health() error
+}
+
+// Status is a snapshot of a module's lifecycle as reported to clients.
+type Status struct {
+	Name       string
+	Optional   bool
+	State      State
+	Changed    time.Time
+	Error      string
+	Timestamps map[State]time.Time
+}
+
+type _state struct {
+	lock      sync.Mutex
+	State     State
+	Changed   time.Time
+	LastError error
+	Since     map[State]time.Time
+}
+
+func (s State) String() string {
+	return States[s]
+}
+
+func (s State) MarshalText() ([]byte, error) {
+	return []byte(s.String()), nil
+}
+
+func (m *_module) Set(s State, e error) {
+	m.lock.Lock()
+	now := time.Now()
+	if m.Since == nil {
+		m.Since = make(map[State]time.Time)
+	}
+	changed := m.State != s || m.Changed.IsZero()
+	if changed == true {
+		debug.Ver("Module: %s is %s", m.m.Name(), s)
+		m.Changed = now
+		m.Since[s] = now
+	}
+	m.State = s
+	m.CanHaveAnError = e
+	if e != nil {
+		m.LastError = e
+	}
+	m.lock.Unlock()
+	if changed == true {
+		// not registered before the first StartAll
+		event.Fire("module-state-changed", m.Status())
+	}
+}
+
+func (m *_module) Get() State {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	return m.State
+}
+
+func (m *_module) Status() Status {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	s := Status{
+		Name:       m.m.Name(),
+		Optional:   m.Requirement == Optional,
+		State:      m.State,
+		Changed:    m.Changed,
+		Timestamps: make(map[State]time.Time),
+	}
+	if m.LastError != nil {
+		s.Error = m.LastError.Error()
+	}
+	for k, v := range m.Since {
+		s.Timestamps[k] = v
+	}
+	return s
+}
+
+// Report is the answer to the module-status command.
+type Report struct {
+	Daemon  State
+	Modules []Status
+}
+
+// Mode returns the state of the daemon as a whole: failed if a
+// required module failed, degraded if an optional module failed or
+// any module is unhealthy, started otherwise.
+func Mode() State {
+	s := Started
+	for _, m := range registered() {
+		switch m.Get() {
+		case Failed:
+			if m.Requirement == Required {
+				return Failed
+			}
+			s = Degraded
+		case Degraded:
+			s = Degraded
+		}
+	}
+	return s
+}
+
+// Check runs the health checks of all running modules and
+// moves them between started and degraded accordingly.
+func Check() {
+	for _, m := range registered() {
+		h, ok := m.m.(IsHealthy)
+		if ok == false {
+			continue
+		}
+		switch m.Get() {
+		case Started, Degraded:
+			if e := h.Health(); e != nil {
+				debug.Warn("Module: %s is unhealthy (%s)", m.m.Name(), e.Error())
+				m.Set(Degraded, e)
+			} else {
+				m.Set(Started, nil)
+			}
+		}
+	}
+}
+
+// GetStatus returns the lifecycle table of all registered modules.
+func GetStatus() []Status {
+	ordered, e := Order()
+	if e != nil {
+		ordered = registered()
+		sort.Slice(ordered, func(i, j int) bool {
+			return ordered[i].m.Name() < ordered[j].m.Name()
+		})
+	}
+	var s []Status
+	for _, m := range ordered {
+		s = append(s, m.Status())
+	}
+	return s
+}
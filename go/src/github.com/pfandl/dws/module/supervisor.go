@@ -0,0 +1,172 @@
+package module
+
+import (
+	"github.com/pfandl/dws/debug"
+	"github.com/pfandl/dws/event"
+	"time"
+)
+
+type RestartMode int
+
+const (
+	// never restart the module
+	Never RestartMode = iota
+	// restart the module if init or start failed
+	OnFailure
+	// like OnFailure, but also restart if the module reports unhealthy
+	Always
+)
+
+var (
+	// how often the supervisor checks modules
+	Interval = 5 * time.Second
+	// used for modules without their own restart policy
+	DefaultPolicy = Policy{Restart: Never}
+	// used if a policy does not specify backoff durations
+	DefaultBackoff    = 1 * time.Second
+	DefaultMaxBackoff = 1 * time.Minute
+
+	supervisorStop chan bool
+	supervisorDone chan bool
+)
+
+type Policy struct {
+	Restart RestartMode
+	// give up after this many restarts in a row, 0 means never give up
+	MaxRetries int
+	// wait before the first restart, doubled for every following one
+	Backoff    time.Duration
+	MaxBackoff time.Duration
+}
+
+type HasRestartPolicy interface {
+	RestartPolicy() Policy
+}
+
+type _supervision struct {
+	initialized bool
+	retries     int
+	next        time.Time
+	gaveUp      bool
+}
+
+// PolicyOf returns the restart policy of m with defaults applied.
+func PolicyOf(m Module) Policy {
+	p := DefaultPolicy
+	if r, ok := m.(HasRestartPolicy); ok {
+		p = r.RestartPolicy()
+	}
+	if p.Backoff <= 0 {
+		p.Backoff = DefaultBackoff
+	}
+	if p.MaxBackoff <= 0 {
+		p.MaxBackoff = DefaultMaxBackoff
+	}
+	return p
+}
+
+func (m *_module) Policy() Policy {
+	return PolicyOf(m.m)
+}
+
+// NeedsRestart reports whether the policy of m asks for a restart
+// in its current state.
+func (m *_module) NeedsRestart() bool {
+	switch m.Get() {
+	case Failed:
+		return m.Policy().Restart != Never
+	case Degraded:
+		return m.Policy().Restart == Always
+	}
+	return false
+}
+
+func (p Policy) Delay(retries int) time.Duration {
+	d := p.Backoff
+	for i := 1; i < retries && d < p.MaxBackoff; i++ {
+		d *= 2
+	}
+	if d > p.MaxBackoff {
+		d = p.MaxBackoff
+	}
+	return d
+}
+
+func supervise(now time.Time) {
+	lockControl()
+	defer unlockControl()
+	Check()
+	ordered, e := Order()
+	if e != nil {
+		debug.Err("Module: cannot supervise (%s)", e.Error())
+		return
+	}
+	for _, m := range ordered {
+		p := m.Policy()
+		if m.NeedsRestart() == false {
+			// forget about earlier restarts once the module
+			// has been running long enough
+			if s := m.Status(); s.State == Started && now.Sub(s.Changed) >= p.MaxBackoff {
+				m.retries = 0
+				m.gaveUp = false
+			}
+			continue
+		}
+		if m.gaveUp == true || now.Before(m.next) {
+			continue
+		}
+		// wait for the module we depend on to come back first
+		if failedDependency(m) != nil {
+			continue
+		}
+		if p.MaxRetries > 0 && m.retries >= p.MaxRetries {
+			m.gaveUp = true
+			debug.Err("Module: giving up on %s after %d restarts", m.m.Name(), m.retries)
+			event.Fire("module-gave-up", m.Status())
+			continue
+		}
+		m.retries++
+		m.next = now.Add(p.Delay(m.retries))
+		debug.Info("Module: restarting %s (attempt %d)", m.m.Name(), m.retries)
+		event.Fire("module-restarting", m.Status())
+		if e := m.Restart(); e != nil {
+			debug.Warn("Module: restarting %s failed (%s)", m.m.Name(), e.Error())
+		}
+	}
+}
+
+// Supervise periodically checks all modules and restarts them
+// according to their restart policy until StopAll is called.
+func Supervise() {
+	if supervisorStop != nil {
+		return
+	}
+	supervisorStop = make(chan bool)
+	supervisorDone = make(chan bool)
+	go func(stop chan bool, done chan bool) {
+		defer close(done)
+		t := time.NewTicker(Interval)
+		defer t.Stop()
+		// do not wait for the first tick, modules might
+		// already have failed during start
+		supervise(time.Now())
+		for {
+			select {
+			case <-stop:
+				return
+			case now := <-t.C:
+				supervise(now)
+			}
+		}
+	}(supervisorStop, supervisorDone)
+}
+
+func stopSupervisor() {
+	if supervisorStop == nil {
+		return
+	}
+	close(supervisorStop)
+	<-supervisorDone
+	supervisorStop = nil
+	supervisorDone = nil
+}
@@ -0,0 +1,66 @@
+package module
+
+import (
+	"testing"
+	"time"
+)
+
+type policyModule struct {
+	orderModule
+	policy Policy
+}
+
+func (p *policyModule) RestartPolicy() Policy { return p.policy }
+
+func TestDelay(t *testing.T) {
+	p := Policy{Backoff: time.Second, MaxBackoff: 10 * time.Second}
+	tests := []struct {
+		policy  Policy
+		retries int
+		delay   time.Duration
+	}{
+		{p, 0, time.Second},
+		{p, 1, time.Second},
+		{p, 2, 2 * time.Second},
+		{p, 3, 4 * time.Second},
+		{p, 4, 8 * time.Second},
+		{p, 5, 10 * time.Second},
+		{p, 100, 10 * time.Second},
+		// the backoff is capped from the start
+		{Policy{Backoff: time.Minute, MaxBackoff: time.Second}, 1, time.Second},
+	}
+	for _, tt := range tests {
+		if d := tt.policy.Delay(tt.retries); d != tt.delay {
+			t.Errorf("%v retry %d: got %v, want %v", tt.policy, tt.retries, d, tt.delay)
+		}
+	}
+}
+
+func TestPolicyOf(t *testing.T) {
+	tests := []struct {
+		name   string
+		m      Module
+		policy Policy
+	}{
+		{
+			name:   "default",
+			m:      &orderModule{name: "test"},
+			policy: Policy{Restart: Never, Backoff: DefaultBackoff, MaxBackoff: DefaultMaxBackoff},
+		},
+		{
+			name:   "without backoff",
+			m:      &policyModule{policy: Policy{Restart: OnFailure, MaxRetries: 3}},
+			policy: Policy{Restart: OnFailure, MaxRetries: 3, Backoff: DefaultBackoff, MaxBackoff: DefaultMaxBackoff},
+		},
+		{
+			name:   "own backoff",
+			m:      &policyModule{policy: Policy{Restart: Always, Backoff: time.Millisecond, MaxBackoff: time.Second}},
+			policy: Policy{Restart: Always, Backoff: time.Millisecond, MaxBackoff: time.Second},
+		},
+	}
+	for _, tt := range tests {
+		if p := PolicyOf(tt.m); p != tt.policy {
+			t.Errorf("%s: got %v, want %v", tt.name, p, tt.policy)
+		}
+	}
+}
@@ -10,8 +10,11 @@ import (
 	"github.com/pfandl/dws/module"
 	"net"
 	"os"
+	"reflect"
 	"strconv"
 	"strings"
+	"sync"
+	"time"
 )
 
 var (
@@ -24,10 +27,15 @@ var (
 		"network-available",
 		"check-command",
 	}
+	// payloads of the events we fire
+	EventTypes = map[string]reflect.Type{
+		"command-result": reflect.TypeOf(&data.Message{}),
+	}
 	// errors
 	CannotParseIpAddress = "cannot parse ip address"
 	IpRemovedFromBridge  = "ip address was removed from bridge"
 	SubnetMismatch       = "configured and actual bridge subnet mismatch"
+	InvalidPayload       = "command data has wrong type"
 	// messages
 	NetworkAdded = "network was added"
 
@@ -36,13 +44,29 @@ var (
 
 type Network struct {
 	module.Module
+	// guards everything below
+	lock     sync.Mutex
 	Networks []*config.Network
+	// networks added by commands, their bridges are ours
+	added map[string]bool
+	// networks added before we are started, e.g. when the journal
+	// is replayed, are brought up by Start
+	started bool
 }
 
 func (c *Network) Name() string {
 	return "network"
 }
 
+// added networks are brought up by us
+func (c *Network) Commands() []module.Command {
+	return []module.Command{{Name: "add-network"}}
+}
+
+func (c *Network) Dependencies() []string {
+	return []string{"config"}
+}
+
 func (c *Network) Events(active bool) []string {
 	debug.Ver("Network: Events %v", active)
 	if active == true {
@@ -52,6 +76,20 @@ func (c *Network) Events(active bool) []string {
 	}
 }
 
+func (c *Network) RestartPolicy() module.Policy {
+	// bridges might come up later, e.g. after a fix-network run
+	return module.Policy{
+		Restart:    module.Always,
+		MaxRetries: 10,
+		Backoff:    2 * time.Second,
+		MaxBackoff: 2 * time.Minute,
+	}
+}
+
+func (c *Network) EventTypes() map[string]reflect.Type {
+	return EventTypes
+}
+
 func (c *Network) Init() error {
 	debug.Ver("Network Init()")
 	// check arguments if fix-network was passed
@@ -66,6 +104,22 @@ func (c *Network) Init() error {
 
 func (c *Network) Start() error {
 	debug.Ver("Network Start()")
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	// bring up the bridges of added networks, after a restart
+	// of the daemon they might already exist
+	for _, n := range c.Networks {
+		if c.added[n.Name] == false {
+			continue
+		}
+		if _, e := tenus.BridgeFromName(n.Name); e == nil {
+			continue
+		}
+		if e := c.CreateBridge(n); e != nil {
+			return e
+		}
+	}
+	c.started = true
 	// check all networks for existance
 	for _, n := range c.Networks {
 		debug.Ver("Network check existance %s", n.Name)
@@ -119,6 +173,17 @@ func (c *Network) Start() error {
 	return nil
 }
 
+func (c *Network) Health() error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	for _, n := range c.Networks {
+		if _, e := tenus.BridgeFromName(n.Name); e != nil {
+			return e
+		}
+	}
+	return nil
+}
+
 func (c *Network) SetBridgeIp(b *tenus.Bridger, n *config.Network) error {
 	debug.Ver("Network SetBridgeIp %v", n)
 	// remove any ip
@@ -132,10 +197,24 @@ func (c *Network) SetBridgeIp(b *tenus.Bridger, n *config.Network) error {
 				}
 			}
 		}*/
+	ip, ipNet, e := address(n)
+	if e != nil {
+		return e
+	}
+	debug.Ver("Network set ip address %v", ip)
+	// set ip
+	if e = (*b).SetLinkIp(ip, ipNet); e != nil {
+		return e
+	}
+	return nil
+}
+
+// address returns the ip address and subnet of the bridge of n.
+func address(n *config.Network) (net.IP, *net.IPNet, error) {
 	// ip parsing
 	ip := net.ParseIP(n.IpV4.Address)
 	if ip == nil {
-		return err.New(CannotParseIpAddress, n.IpV4.Address)
+		return nil, nil, err.New(CannotParseIpAddress, n.IpV4.Address)
 	}
 	// subnet parsing
 	subs := strings.Split(n.IpV4.Subnet, ".")
@@ -150,12 +229,7 @@ func (c *Network) SetBridgeIp(b *tenus.Bridger, n *config.Network) error {
 		byte(int32(bb)),
 		byte(int32(cc)),
 		byte(int32(dd)))
-	debug.Ver("Network set ip address %v", ip)
-	// set ip
-	if e = (*b).SetLinkIp(ip, &ipNet); e != nil {
-		return e
-	}
-	return nil
+	return ip, &ipNet, e
 }
 
 func (c *Network) CreateBridge(n *config.Network) error {
@@ -177,6 +251,9 @@ func (c *Network) CreateBridge(n *config.Network) error {
 
 func (c *Network) Stop() error {
 	debug.Ver("Network Stop()")
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.started = false
 	return nil
 }
 
@@ -188,35 +265,146 @@ func (c *Network) Event(e string, v interface{}) {
 	case "check-command":
 		c.CheckCommand(v.(*data.Message))
 	default:
-		debug.Fat("Network event %s unknown", e)
+		debug.Err("Network event %s unknown", e)
 	}
 }
 
 func (c *Network) CheckCommand(m *data.Message) {
 	debug.Ver("Network CheckCommand: %v", m)
+	switch m.Message {
+	case "add-network":
+		c.Added(m)
+	// answered by the config, we only follow it
+	case "update-network":
+		c.Updated(m)
+	case "remove-network":
+		c.Removed(m)
+	}
+}
+
+// find returns the index of the network s,
+// must be called with the lock held.
+func (c *Network) find(s string) int {
+	for i, n := range c.Networks {
+		if n.Name == s {
+			return i
+		}
+	}
+	return -1
 }
 
 func (c *Network) Add(n *config.Network) {
 	debug.Ver("Network Add: %v", n)
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.add(n)
+}
+
+func (c *Network) add(n *config.Network) {
 	c.Networks = append(c.Networks, n)
 }
 
-func (c *Network) Added(m *data.Message) {
-	debug.Ver("Network network available: %v", m.Data)
-	n := m.Data.(config.Network)
+// own marks the bridge of the network s as created by us,
+// must be called with the lock held.
+func (c *Network) own(s string) {
+	if c.added == nil {
+		c.added = make(map[string]bool)
+	}
+	c.added[s] = true
+}
 
+func (c *Network) Added(cm *data.Message) {
+	debug.Ver("Network network available: %v", cm.Data)
+	// the command is shared with the other listeners, answer a copy
+	r := *cm
+	m := &r
 	// fire result event after function is done
 	defer func() {
-		event.Fire("add-network-result", m)
+		event.Fire("command-result", m)
 	}()
 
+	var n config.Network
+	if config.Payload(m, &n) == false {
+		m.Succeeded = false
+		m.Message = err.New(InvalidPayload, m.Message).Error()
+		return
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	// not started yet, Start brings it up
+	if c.started == false {
+		m.Succeeded = true
+		m.Message = NetworkAdded
+		c.add(&n)
+		c.own(n.Name)
+		return
+	}
 	if err := c.CreateBridge(&n); err != nil {
 		m.Succeeded = false
 		m.Message = err.Error()
 	} else {
 		m.Succeeded = true
 		m.Message = NetworkAdded
-		c.Add(&n)
+		c.add(&n)
+		c.own(n.Name)
+	}
+}
+
+// Updated moves the bridge of the updated network to its new address.
+func (c *Network) Updated(m *data.Message) {
+	debug.Ver("Network update: %v", m.Data)
+	var n config.Network
+	if config.Payload(m, &n) == false {
+		debug.Warn("Network cannot update (%s)", err.New(InvalidPayload, m.Message).Error())
+		return
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	i := c.find(n.Name)
+	if i < 0 {
+		return
+	}
+	old := c.Networks[i]
+	c.Networks[i] = &n
+	if c.started == false {
+		return
+	}
+	if old.IpV4.Address == n.IpV4.Address && old.IpV4.Subnet == n.IpV4.Subnet {
+		return
+	}
+	b, e := tenus.BridgeFromName(n.Name)
+	if e != nil {
+		debug.Err("Network cannot update bridge %s (%s)", n.Name, e.Error())
+		return
+	}
+	if ip, ipNet, e := address(old); e == nil {
+		if e := b.UnsetLinkIp(ip, ipNet); e != nil {
+			debug.Warn("Network cannot remove ip %s from %s (%s)", old.IpV4.Address, n.Name, e.Error())
+		}
+	}
+	if e := c.SetBridgeIp(&b, &n); e != nil {
+		debug.Err("Network cannot update bridge %s (%s)", n.Name, e.Error())
+	}
+}
+
+// Removed deletes the bridge of the removed network.
+func (c *Network) Removed(m *data.Message) {
+	debug.Ver("Network remove: %v", m.Data)
+	s, _ := m.Data.(string)
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	i := c.find(s)
+	if i < 0 {
+		return
+	}
+	c.Networks = append(c.Networks[:i:i], c.Networks[i+1:]...)
+	delete(c.added, s)
+	if c.started == false {
+		return
+	}
+	if e := tenus.DeleteLink(s); e != nil {
+		debug.Err("Network cannot delete bridge %s (%s)", s, e.Error())
 	}
 }
 
@@ -0,0 +1,441 @@
+// Package plugin runs modules as external executables. The daemon
+// talks to a plugin by writing one data.Message as JSON per line to
+// its stdin and reading one per line from its stdout.
+//
+// Requests carry "name", "events", "init", "start" or "stop" as
+// Message (plus true or false as Data for "events") and an Id. They
+// are answered by a single line with the Id of the request and
+// Succeeded, Message and Data set, answers with another Id are
+// dropped. Events the plugin subscribed to are sent as Message
+// "event" with an Event as Data and are not answered. A line with
+// Message "fire" and an Event as Data fires that event within the
+// daemon.
+package plugin
+
+import (
+	"bufio"
+	"encoding/json"
+	"github.com/pfandl/dws/config"
+	"github.com/pfandl/dws/data"
+	"github.com/pfandl/dws/debug"
+	"github.com/pfandl/dws/error"
+	"github.com/pfandl/dws/event"
+	"github.com/pfandl/dws/module"
+	"io"
+	"os"
+	"os/exec"
+	"sync"
+	"time"
+)
+
+var (
+	// events we fire
+	ActiveEvents = []string{}
+	// events we are interested in
+	PassiveEvents = []string{
+		"plugin-available",
+	}
+	// how long to wait for a plugin to answer a request
+	Timeout = 10 * time.Second
+	// longest line a plugin may write
+	MaxLineSize = 1024 * 1024
+	// errors
+	PluginNotRunning  = "plugin is not running"
+	PluginExited      = "plugin exited"
+	PluginTimeout     = "plugin did not answer in time"
+	PluginRequestFail = "plugin request failed"
+	PluginMayNotFire  = "plugin may not fire event"
+
+	// events a plugin may not fire, commands have to go through
+	// module.Execute to be authorized
+	forbidden = map[string]bool{
+		"command":       true,
+		"check-command": true,
+	}
+)
+
+type Event struct {
+	Name  string
+	Value json.RawMessage
+}
+
+// Plugins is the module that spawns all configured plugins.
+type Plugins struct {
+	module.Module
+	Configs []*config.Plugin
+	Plugins []*Plugin
+}
+
+func (c *Plugins) Name() string {
+	return "plugin"
+}
+
+func (c *Plugins) Dependencies() []string {
+	return []string{"config"}
+}
+
+func (c *Plugins) Events(active bool) []string {
+	debug.Ver("Plugins: Events %v", active)
+	if active == true {
+		return ActiveEvents
+	} else {
+		return PassiveEvents
+	}
+}
+
+func (c *Plugins) Event(e string, v interface{}) {
+	debug.Ver("Plugins got event: %s %v", e, v)
+	switch e {
+	case "plugin-available":
+		c.Available(v.(*config.Plugin))
+	default:
+		debug.Err("Plugins event %s unknown", e)
+	}
+}
+
+func (c *Plugins) Init() error {
+	debug.Ver("Plugins Init()")
+	return nil
+}
+
+func (c *Plugins) Start() error {
+	debug.Ver("Plugins Start()")
+	for _, p := range c.Configs {
+		// plugins that are already loaded are taken care
+		// of by the supervisor
+		if c.loaded(p) == true {
+			continue
+		}
+		pp, e := New(p)
+		if e != nil {
+			debug.Err("Plugins cannot spawn %s (%s)", p.Name, e.Error())
+			continue
+		}
+		if e := module.Load(pp, module.Optional); e != nil {
+			debug.Err("Plugins cannot load %s (%s)", p.Name, e.Error())
+			pp.kill()
+			continue
+		}
+		c.Plugins = append(c.Plugins, pp)
+	}
+	return nil
+}
+
+// loaded returns whether the plugin configured by p is registered,
+// under the name the plugin told us.
+func (c *Plugins) loaded(p *config.Plugin) bool {
+	for _, pp := range c.Plugins {
+		if pp.Config != p {
+			continue
+		}
+		if _, e := module.Get(pp.Name()); e == nil {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *Plugins) Stop() error {
+	debug.Ver("Plugins Stop()")
+	return nil
+}
+
+func (c *Plugins) Available(p *config.Plugin) {
+	debug.Ver("Plugins available: %v", p)
+	c.Configs = append(c.Configs, p)
+}
+
+// Plugin is a module living in an external process.
+type Plugin struct {
+	module.Module
+	Config *config.Plugin
+	// set under the lock, it is read by the reader of the plugin
+	name    string
+	active  []string
+	passive []string
+	// one request at a time
+	call    sync.Mutex
+	lock    sync.Mutex
+	cmd     *exec.Cmd
+	stdin   io.WriteCloser
+	replies chan *data.Message
+	exited  chan bool
+	// set while we are stopping the plugin on purpose
+	stopping bool
+}
+
+// New spawns the plugin and asks it for its name and events.
+func New(c *config.Plugin) (*Plugin, error) {
+	p := &Plugin{Config: c}
+	if e := p.spawn(); e != nil {
+		return nil, e
+	}
+	m, e := p.Request("name", nil)
+	if e != nil {
+		p.kill()
+		return nil, e
+	}
+	name, _ := m.Data.(string)
+	if name == "" {
+		name = c.Name
+	}
+	p.lock.Lock()
+	p.name = name
+	p.lock.Unlock()
+	if p.active, e = p.events(true); e != nil {
+		p.kill()
+		return nil, e
+	}
+	if p.passive, e = p.events(false); e != nil {
+		p.kill()
+		return nil, e
+	}
+	return p, nil
+}
+
+func (c *Plugin) spawn() error {
+	debug.Ver("Plugin spawning %s", c.Config.Path)
+	cmd := exec.Command(c.Config.Path, c.Config.Arguments...)
+	cmd.Stderr = os.Stderr
+	stdin, e := cmd.StdinPipe()
+	if e != nil {
+		return e
+	}
+	stdout, e := cmd.StdoutPipe()
+	if e != nil {
+		return e
+	}
+	if e := cmd.Start(); e != nil {
+		return e
+	}
+	c.lock.Lock()
+	c.cmd = cmd
+	c.stdin = stdin
+	c.replies = make(chan *data.Message, 1)
+	c.exited = make(chan bool)
+	c.stopping = false
+	c.lock.Unlock()
+	go c.read(cmd, stdout, c.replies, c.exited)
+	return nil
+}
+
+func (c *Plugin) read(cmd *exec.Cmd, r io.Reader, replies chan *data.Message, exited chan bool) {
+	s := bufio.NewScanner(r)
+	s.Buffer(make([]byte, 4096), MaxLineSize)
+	for s.Scan() {
+		m := &data.Message{}
+		if e := json.Unmarshal(s.Bytes(), m); e != nil {
+			debug.Warn("Plugin %s sent garbage (%s)", c.Config.Name, e.Error())
+			continue
+		}
+		if m.Message == "fire" {
+			c.fire(m)
+			continue
+		}
+		select {
+		case replies <- m:
+		default:
+			debug.Warn("Plugin %s sent unexpected reply %v", c.Config.Name, m)
+		}
+	}
+	e := cmd.Wait()
+	close(exited)
+	if e == nil {
+		e = err.New(PluginExited, c.Config.Name)
+	} else {
+		e = err.New(PluginExited, c.Config.Name, e.Error())
+	}
+	c.lock.Lock()
+	name := c.name
+	stopping := c.stopping
+	c.lock.Unlock()
+	// let the supervisor decide what to do with us
+	if name != "" && stopping == false {
+		module.Fail(name, e)
+	}
+}
+
+func (c *Plugin) fire(m *data.Message) {
+	b, _ := json.Marshal(m.Data)
+	var ev Event
+	if e := json.Unmarshal(b, &ev); e != nil {
+		debug.Warn("Plugin %s fired invalid event (%s)", c.Config.Name, e.Error())
+		return
+	}
+	if forbidden[ev.Name] == true {
+		debug.Warn("Plugin %s cannot fire %s (%s)", c.Config.Name, ev.Name, err.New(PluginMayNotFire, ev.Name).Error())
+		return
+	}
+	// decode into the payload type of the event if it has one
+	v, e := event.Decode(ev.Name, ev.Value)
+	if e != nil {
+		debug.Warn("Plugin %s fired invalid event (%s)", c.Config.Name, e.Error())
+		return
+	}
+	if e := event.Fire(ev.Name, v); e != nil {
+		debug.Warn("Plugin %s cannot fire %s (%s)", c.Config.Name, ev.Name, e.Error())
+	}
+}
+
+func (c *Plugin) running() bool {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.exited == nil {
+		return false
+	}
+	select {
+	case <-c.exited:
+		return false
+	default:
+		return true
+	}
+}
+
+func (c *Plugin) write(m *data.Message) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.stdin == nil {
+		return err.New(PluginNotRunning, c.Config.Name)
+	}
+	b, e := json.Marshal(m)
+	if e != nil {
+		return e
+	}
+	_, e = c.stdin.Write(append(b, '\n'))
+	return e
+}
+
+// Request sends s to the plugin and waits for its answer.
+func (c *Plugin) Request(s string, v interface{}) (*data.Message, error) {
+	c.call.Lock()
+	defer c.call.Unlock()
+	if c.running() == false {
+		return nil, err.New(PluginNotRunning, c.Config.Name)
+	}
+	id := event.NewId()
+	if e := c.write(&data.Message{Id: id, Message: s, Data: v}); e != nil {
+		return nil, e
+	}
+	t := time.NewTimer(Timeout)
+	defer t.Stop()
+	for {
+		select {
+		case m := <-c.replies:
+			// a late answer to a request that timed out
+			if m.Id != id {
+				debug.Warn("Plugin %s sent unexpected reply %v", c.Config.Name, m)
+				continue
+			}
+			if m.Succeeded == false {
+				return m, err.New(PluginRequestFail, c.Config.Name, s, m.Message)
+			}
+			return m, nil
+		case <-c.exited:
+			return nil, err.New(PluginExited, c.Config.Name)
+		case <-t.C:
+			return nil, err.New(PluginTimeout, c.Config.Name, s)
+		}
+	}
+}
+
+func (c *Plugin) events(active bool) ([]string, error) {
+	m, e := c.Request("events", active)
+	if e != nil {
+		return nil, e
+	}
+	var s []string
+	if l, ok := m.Data.([]interface{}); ok {
+		for _, i := range l {
+			if ss, ok := i.(string); ok {
+				s = append(s, ss)
+			}
+		}
+	}
+	return s, nil
+}
+
+func (c *Plugin) kill() {
+	c.lock.Lock()
+	cmd := c.cmd
+	c.lock.Unlock()
+	if cmd != nil && cmd.Process != nil {
+		cmd.Process.Kill()
+	}
+}
+
+func (c *Plugin) Name() string {
+	return c.name
+}
+
+func (c *Plugin) Dependencies() []string {
+	return []string{"plugin"}
+}
+
+func (c *Plugin) RestartPolicy() module.Policy {
+	return module.Policy{
+		Restart:    module.OnFailure,
+		MaxRetries: 5,
+	}
+}
+
+func (c *Plugin) Events(active bool) []string {
+	if active == true {
+		return c.active
+	}
+	return c.passive
+}
+
+func (c *Plugin) Event(e string, v interface{}) {
+	debug.Ver("Plugin %s got event: %s %v", c.name, e, v)
+	b, er := json.Marshal(v)
+	if er != nil {
+		debug.Warn("Plugin %s cannot convert event %s (%s)", c.name, e, er.Error())
+		return
+	}
+	if er := c.write(&data.Message{Message: "event", Data: Event{Name: e, Value: b}}); er != nil {
+		debug.Warn("Plugin %s cannot deliver event %s (%s)", c.name, e, er.Error())
+	}
+}
+
+func (c *Plugin) Init() error {
+	debug.Ver("Plugin %s Init()", c.name)
+	_, e := c.Request("init", nil)
+	return e
+}
+
+func (c *Plugin) Start() error {
+	debug.Ver("Plugin %s Start()", c.name)
+	// respawn after a crash, the new process has to be initialized again
+	if c.running() == false {
+		if e := c.spawn(); e != nil {
+			return e
+		}
+		if e := c.Init(); e != nil {
+			return e
+		}
+	}
+	_, e := c.Request("start", nil)
+	return e
+}
+
+func (c *Plugin) Stop() error {
+	debug.Ver("Plugin %s Stop()", c.name)
+	if c.running() == false {
+		return nil
+	}
+	// it may exit before answering
+	c.lock.Lock()
+	c.stopping = true
+	c.lock.Unlock()
+	_, e := c.Request("stop", nil)
+	c.lock.Lock()
+	c.stdin.Close()
+	c.lock.Unlock()
+	// give it a moment to exit on its own
+	select {
+	case <-c.exited:
+	case <-time.After(Timeout):
+		c.kill()
+	}
+	return e
+}
@@ -1,47 +1,108 @@
 package server
 
 import (
+	"context"
+	"errors"
+	"github.com/pfandl/dws/communication"
 	"github.com/pfandl/dws/config"
 	"github.com/pfandl/dws/data"
 	"github.com/pfandl/dws/debug"
+	"github.com/pfandl/dws/error"
 	"github.com/pfandl/dws/event"
 	"github.com/pfandl/dws/module"
 	"net"
+	"reflect"
+	"sync"
+	"time"
 )
 
 var (
 	// events we fire
 	ActiveEvents = []string{
 		"command",
+		"command-result",
 	}
 	// events we are interested in
 	PassiveEvents = []string{
 		"server-available",
-		"command-result",
 		"check-command",
 	}
+	// payloads of the events we fire
+	EventTypes = map[string]reflect.Type{
+		"command":        reflect.TypeOf(&data.Message{}),
+		"command-result": reflect.TypeOf(&data.Message{}),
+	}
+	// how long a client waits for the result of a command
+	Timeout = 30 * time.Second
 	// errors
-	CommandHasNoInterface = "command does not contain originating interface"
-	CannotConvertToThread = "cannot convert data to Thread"
+	InvalidPayload  = "command data has wrong type"
+	NeedsConnection = "command needs a connection"
 	// messages
-	ServerAdded = "server was added"
+	ServerAdded        = "server was added"
+	EventsSubscribed   = "events are pushed"
+	EventsUnsubscribed = "events are no longer pushed"
+
+	// guards subscriptions
+	subscriptionLock sync.Mutex
+	// events pushed per connection
+	subscriptions = make(map[*communication.Connection][]*event.Subscription)
 )
 
+// Subscription selects the events pushed to a client.
+type Subscription struct {
+	// event names or patterns, e.g. "*-available"
+	Events []string
+	// fields the payload must have, e.g. {"Name": "main"}
+	Match map[string]string
+}
+
 type Thread struct {
 	Running bool
 	Server  *config.Server
-	Channel chan *data.Message
+	// guards listeners
+	lock sync.Mutex
+	// closed by Stop
+	listeners []net.Listener
 }
 
 type Server struct {
 	module.Module
+	// guards everything below
+	lock    sync.Mutex
 	Servers []*Thread
+	// servers added before we are started, e.g. when the journal
+	// is replayed, are listened on by Start
+	started bool
 }
 
 func (c *Server) Name() string {
 	return "server"
 }
 
+func (c *Server) Commands() []module.Command {
+	return []module.Command{
+		// added servers are started by us
+		{Name: "add-server"},
+		{
+			Name:        "subscribe-events",
+			Type:        reflect.TypeOf(Subscription{}),
+			Permissions: []module.Permission{module.Read},
+			Help:        "pushes the selected events over the connection of the client",
+			Handler:     subscribe,
+		},
+		{
+			Name:        "unsubscribe-events",
+			Permissions: []module.Permission{module.Read},
+			Help:        "stops pushing events over the connection of the client",
+			Handler:     unsubscribe,
+		},
+	}
+}
+
+func (c *Server) Dependencies() []string {
+	return []string{"config", "backingstore"}
+}
+
 func (c *Server) Events(active bool) []string {
 	debug.Ver("Server: Events %v", active)
 	if active == true {
@@ -51,6 +112,10 @@ func (c *Server) Events(active bool) []string {
 	}
 }
 
+func (c *Server) EventTypes() map[string]reflect.Type {
+	return EventTypes
+}
+
 func (c *Server) Init() error {
 	debug.Ver("Server Init()")
 	return nil
@@ -58,54 +123,112 @@ func (c *Server) Init() error {
 
 func (c *Server) Start() error {
 	debug.Ver("Server Start()")
+	c.lock.Lock()
+	defer c.lock.Unlock()
 	for _, s := range c.Servers {
 		if err := s.Start(); err != nil {
+			c.stop()
 			return err
 		}
 	}
+	c.started = true
 	return nil
 }
 
 func (c *Thread) Start() error {
 	debug.Ver("Thread Start()")
-	if l, err := net.Listen("tcp", ":"+c.Server.IpV4.Port); err != nil {
+	t, err := c.Server.IpV4.Tls.ListenConfig()
+	if err != nil {
+		return err
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if l, err := communication.Listen(":"+c.Server.IpV4.Port, t); err != nil {
 		return err
 	} else {
+		c.listeners = append(c.listeners, l)
 		// run in thread
 		go c.Run(&l)
 	}
+	if c.Server.Socket != nil {
+		if l, err := c.listenSocket(); err != nil {
+			c.stop()
+			return err
+		} else {
+			c.listeners = append(c.listeners, l)
+			go c.RunSocket(l, c.Server.Socket)
+		}
+	}
+	c.Running = true
 	return nil
 }
 
+// Stop closes the listeners of c, established connections are kept.
+func (c *Thread) Stop() {
+	debug.Ver("Thread Stop()")
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.stop()
+}
+
+func (c *Thread) stop() {
+	for _, l := range c.listeners {
+		l.Close()
+	}
+	c.listeners = nil
+	c.Running = false
+}
+
 func (c *Thread) Run(l *net.Listener) {
 	debug.Ver("Thread Run()")
 
-	// should be enough for most messages
-	s := 2048
-	b := make([]byte, s)
-
-	c.Running = true
-	for c.Running {
+	for {
 		debug.Ver("Thread Waiting...()")
 		conn, err := (*l).Accept()
-		if err != nil {
+		if errors.Is(err, net.ErrClosed) == true {
+			return
+		} else if err != nil {
 			debug.Err("Thread connection failed %s", err.Error())
 			continue
 		}
 		debug.Ver("Thread connection established wtih %s", conn.RemoteAddr().String())
-		conn.Read(b)
+		// requests are handled concurrently until the client closes
+		// the connection, handling them is cancelled if it breaks
+		go communication.NewConnection(event.Background(), conn).Serve(c.handle)
+	}
+}
 
-		s := <-c.Channel
-		conn.Write([]byte(s.ToJson()))
-		conn.Close()
+func (c *Thread) handle(conn *communication.Connection, b []byte) {
+	if err := conn.Send(c.answer(conn.Context(), b).ToJson()); err != nil {
+		debug.Warn("Thread cannot answer %s", err.Error())
 	}
 }
 
+// answer returns the answer to the request b.
+func (c *Thread) answer(ctx context.Context, b []byte) *data.Envelope {
+	env, e := data.ParseEnvelope(b)
+	if e != nil {
+		return env.Reply(e)
+	}
+	return module.Execute(ctx, env, Timeout)
+}
+
 func (c *Server) Stop() error {
 	debug.Ver("Server Stop()")
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.stop()
+	c.started = false
 	return nil
 }
 
+// stop stops all threads, must be called with the lock held.
+func (c *Server) stop() {
+	for _, s := range c.Servers {
+		s.Stop()
+	}
+}
+
 func (c *Server) Event(e string, v interface{}) {
 	debug.Ver("Server got event: %s %v", e, v)
 	switch e {
@@ -113,10 +236,8 @@ func (c *Server) Event(e string, v interface{}) {
 		c.Available(v.(*config.Server))
 	case "check-command":
 		c.CheckCommand(v.(*data.Message))
-	case "command-result":
-		c.Result(v.(*data.Message))
 	default:
-		debug.Fat("Server event %s unknown", e)
+		debug.Err("Server event %s unknown", e)
 	}
 }
 
@@ -125,19 +246,23 @@ func (c *Server) CheckCommand(m *data.Message) {
 	switch m.Message {
 	case "add-server":
 		c.Added(m)
+	// answered by the config, we only follow it
+	case "update-server":
+		c.Updated(m)
+	case "remove-server":
+		c.Removed(m)
 	}
 }
 
-func (c *Server) Result(m *data.Message) {
-	debug.Ver("Server Result: %v", m)
-	if m.Interface == nil {
-		debug.Fat(CommandHasNoInterface)
-	}
-	if t, ok := (*m.Interface).(Thread); ok == false {
-		t.Channel <- m
-	} else {
-		debug.Fat(CannotConvertToThread)
+// find returns the index of the thread of the server s,
+// must be called with the lock held.
+func (c *Server) find(s string) int {
+	for i, t := range c.Servers {
+		if t.Server.Name == s {
+			return i
+		}
 	}
+	return -1
 }
 
 func (c *Server) CreateThread(s *config.Server) (*Thread, error) {
@@ -151,6 +276,12 @@ func (c *Server) CreateThread(s *config.Server) (*Thread, error) {
 
 func (c *Server) Add(s *config.Server, t *Thread) {
 	debug.Ver("Server Add: %v", s)
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.add(s, t)
+}
+
+func (c *Server) add(s *config.Server, t *Thread) {
 	if t == nil {
 		t = &Thread{
 			Server:  s,
@@ -160,26 +291,176 @@ func (c *Server) Add(s *config.Server, t *Thread) {
 	c.Servers = append(c.Servers, t)
 }
 
-func (c *Server) Added(m *data.Message) {
-	debug.Ver("Server add: %v", m.Data)
-	s := m.Data.(config.Server)
-
+func (c *Server) Added(cm *data.Message) {
+	debug.Ver("Server add: %v", cm.Data)
+	// the command is shared with the other listeners, answer a copy
+	r := *cm
+	m := &r
 	// fire result event after function is done
 	defer func() {
 		event.Fire("command-result", m)
 	}()
 
+	var s config.Server
+	if config.Payload(m, &s) == false {
+		m.Succeeded = false
+		m.Message = err.New(InvalidPayload, m.Message).Error()
+		return
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	// not started yet, Start listens on it
+	if c.started == false {
+		m.Succeeded = true
+		m.Message = ServerAdded
+		c.add(&s, nil)
+		return
+	}
 	if t, err := c.CreateThread(&s); err != nil {
 		m.Succeeded = false
 		m.Message = err.Error()
 	} else {
 		m.Succeeded = true
 		m.Message = ServerAdded
-		c.Add(&s, t)
+		c.add(&s, t)
+	}
+}
+
+// Updated listens on the addresses of the updated server.
+func (c *Server) Updated(m *data.Message) {
+	debug.Ver("Server update: %v", m.Data)
+	var s config.Server
+	if config.Payload(m, &s) == false {
+		debug.Warn("Server cannot update (%s)", err.New(InvalidPayload, m.Message).Error())
+		return
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	i := c.find(s.Name)
+	if i < 0 {
+		return
+	}
+	t := c.Servers[i]
+	t.Stop()
+	t.Server = &s
+	if c.started == false {
+		return
+	}
+	if e := t.Start(); e != nil {
+		debug.Err("Server cannot listen for %s (%s)", s.Name, e.Error())
+	}
+}
+
+// Removed stops listening for the removed server.
+func (c *Server) Removed(m *data.Message) {
+	debug.Ver("Server remove: %v", m.Data)
+	s, _ := m.Data.(string)
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	i := c.find(s)
+	if i < 0 {
+		return
 	}
+	c.Servers[i].Stop()
+	c.Servers = append(c.Servers[:i:i], c.Servers[i+1:]...)
 }
 
 func (c *Server) Available(s *config.Server) {
 	debug.Ver("Server available: %v", s)
 	c.Add(s, nil)
 }
+
+func subscribe(ctx context.Context, m *data.Message) {
+	defer func() {
+		event.Fire("command-result", m)
+	}()
+
+	conn := communication.FromContext(ctx)
+	s, ok := m.Data.(Subscription)
+	if conn == nil || ok == false {
+		m.Succeeded = false
+		if conn == nil {
+			m.Message = err.New(NeedsConnection, m.Message).Error()
+		} else {
+			m.Message = err.New(InvalidPayload, m.Message).Error()
+		}
+		return
+	}
+
+	var subs []*event.Subscription
+	for _, p := range s.Events {
+		sub, err := event.SubscribePattern(p, func(e string, v interface{}) {
+			push(ctx, conn, e, v, s.Match)
+		})
+		if err != nil {
+			for _, sub := range subs {
+				sub.Cancel()
+			}
+			m.Succeeded = false
+			m.Message = err.Error()
+			return
+		}
+		subs = append(subs, sub)
+	}
+
+	subscriptionLock.Lock()
+	first := subscriptions[conn] == nil
+	subscriptions[conn] = append(subscriptions[conn], subs...)
+	subscriptionLock.Unlock()
+	if first == true {
+		conn.OnClose(func() {
+			unsubscribeAll(conn)
+		})
+	}
+	m.Succeeded = true
+	m.Message = EventsSubscribed
+}
+
+func unsubscribe(ctx context.Context, m *data.Message) {
+	conn := communication.FromContext(ctx)
+	if conn == nil {
+		m.Succeeded = false
+		m.Message = err.New(NeedsConnection, m.Message).Error()
+	} else {
+		unsubscribeAll(conn)
+		m.Succeeded = true
+		m.Message = EventsUnsubscribed
+	}
+	event.Fire("command-result", m)
+}
+
+func unsubscribeAll(conn *communication.Connection) {
+	subscriptionLock.Lock()
+	subs := subscriptions[conn]
+	delete(subscriptions, conn)
+	subscriptionLock.Unlock()
+	for _, s := range subs {
+		s.Cancel()
+	}
+}
+
+// push sends the event e to the client of conn if it matches and the
+// client may see it, it is dropped if the client does not keep up. A
+// revoked or expired token of the client ends all its subscriptions.
+func push(ctx context.Context, conn *communication.Connection, e string, v interface{}, match map[string]string) {
+	if data.IsPrivate(v) == true || module.MaySee(ctx, e) == false {
+		return
+	}
+	if module.Valid(ctx) == false {
+		debug.Info("Server token of %s is no longer valid", conn.Connection.RemoteAddr().String())
+		unsubscribeAll(conn)
+		return
+	}
+	env, err := data.Push(e, v)
+	if err != nil {
+		debug.Warn("Server cannot push %s (%s)", e, err.Error())
+		return
+	}
+	if env.Matches(match) == false {
+		return
+	}
+	if conn.Push(env.ToJson()) == false {
+		debug.Warn("Server dropping %s for %s", e, conn.Connection.RemoteAddr().String())
+	}
+}
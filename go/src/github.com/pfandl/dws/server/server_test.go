@@ -0,0 +1,119 @@
+package server
+
+import (
+	"encoding/json"
+	"github.com/pfandl/dws/config"
+	"github.com/pfandl/dws/data"
+	"github.com/pfandl/dws/event"
+	"net"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// port returns a port nobody listens on.
+func port(t *testing.T) string {
+	l, e := net.Listen("tcp", ":0")
+	if e != nil {
+		t.Fatal(e)
+	}
+	defer l.Close()
+	_, p, _ := net.SplitHostPort(l.Addr().String())
+	return p
+}
+
+func TestReplayAddServer(t *testing.T) {
+	if _, e := event.RegisterEvent("check-command", reflect.TypeOf(&data.Message{})); e != nil {
+		t.Fatal(e)
+	}
+	defer event.UnRegisterEvent("check-command")
+	c := &Server{}
+	sub, e := event.Subscribe("check-command", c.Event)
+	if e != nil {
+		t.Fatal(e)
+	}
+	defer sub.Cancel()
+
+	s := config.Server{Name: "test"}
+	s.IpV4.Port = port(t)
+	b, _ := json.Marshal(&data.Message{Message: "add-server", Succeeded: true, Data: s})
+	j, e := event.OpenJournal(filepath.Join(t.TempDir(), "journal"))
+	if e != nil {
+		t.Fatal(e)
+	}
+	defer j.Close()
+	if e := j.Append(&event.Record{Event: "check-command", Time: time.Now(), Payload: b}); e != nil {
+		t.Fatal(e)
+	}
+
+	// replayed before we are started, as StartAll does
+	if n, e := j.Replay(); e != nil || n != 1 {
+		t.Fatalf("replayed %d records (%v)", n, e)
+	}
+	event.Flush()
+	if len(c.Servers) != 1 {
+		t.Fatalf("got %d servers, want 1", len(c.Servers))
+	}
+	if e := c.Start(); e != nil {
+		t.Fatalf("start after replay: %v", e)
+	}
+	defer c.Stop()
+	conn, e := net.Dial("tcp", "127.0.0.1:"+s.IpV4.Port)
+	if e != nil {
+		t.Fatalf("added server is not listening: %v", e)
+	}
+	conn.Close()
+}
+
+func listening(p string) bool {
+	conn, e := net.Dial("tcp", "127.0.0.1:"+p)
+	if e != nil {
+		return false
+	}
+	conn.Close()
+	return true
+}
+
+func TestFollowConfig(t *testing.T) {
+	first, second := port(t), port(t)
+	s := &config.Server{Name: "test"}
+	s.IpV4.Port = first
+	c := &Server{}
+	c.Available(s)
+	if e := c.Start(); e != nil {
+		t.Fatal(e)
+	}
+	defer c.Stop()
+
+	moved := config.Server{Name: "test"}
+	moved.IpV4.Port = second
+	tests := []struct {
+		name string
+		f    func()
+		// ports listened on afterwards
+		first, second bool
+	}{
+		{"started", func() {}, true, false},
+		{"updated", func() {
+			c.CheckCommand(&data.Message{Message: "update-server", Succeeded: true, Data: moved})
+		}, false, true},
+		{"stopped", func() { c.Stop() }, false, false},
+		{"restarted", func() { c.Start() }, false, true},
+		{"removed", func() {
+			c.CheckCommand(&data.Message{Message: "remove-server", Succeeded: true, Data: "test"})
+		}, false, false},
+	}
+	for _, tt := range tests {
+		tt.f()
+		if got := listening(first); got != tt.first {
+			t.Errorf("%s: listening on first port %v, want %v", tt.name, got, tt.first)
+		}
+		if got := listening(second); got != tt.second {
+			t.Errorf("%s: listening on second port %v, want %v", tt.name, got, tt.second)
+		}
+	}
+	if len(c.Servers) != 0 {
+		t.Errorf("got %d servers after removal", len(c.Servers))
+	}
+}
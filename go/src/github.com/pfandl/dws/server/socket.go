@@ -0,0 +1,174 @@
+package server
+
+import (
+	"errors"
+	"github.com/pfandl/dws/communication"
+	"github.com/pfandl/dws/config"
+	"github.com/pfandl/dws/debug"
+	"github.com/pfandl/dws/error"
+	"github.com/pfandl/dws/event"
+	"github.com/pfandl/dws/module"
+	"net"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"syscall"
+	"unsafe"
+)
+
+var (
+	// errors
+	SocketInUse   = "socket is used by another process"
+	NotASocket    = "path exists and is no socket"
+	NoCredentials = "cannot get credentials of peer"
+	UnknownGroup  = "unknown socket group"
+)
+
+// listenSocket listens on the socket of the server, a socket left
+// behind by a previous run is removed. Only we and the members of the
+// group of the socket may connect, the access rules apply on top.
+func (c *Thread) listenSocket() (net.Listener, error) {
+	p := c.Server.Socket.Path
+	if fi, e := os.Lstat(p); e == nil {
+		if fi.Mode()&os.ModeSocket == 0 {
+			return nil, err.New(NotASocket, p)
+		}
+		if conn, e := net.Dial("unix", p); e == nil {
+			conn.Close()
+			return nil, err.New(SocketInUse, p)
+		}
+		if e := os.Remove(p); e != nil {
+			return nil, e
+		}
+	}
+	if e := os.MkdirAll(filepath.Dir(p), 0755); e != nil {
+		return nil, e
+	}
+	l, e := net.Listen("unix", p)
+	if e != nil {
+		return nil, e
+	}
+	mode := os.FileMode(0600)
+	if g := c.Server.Socket.Group; g != "" {
+		gid, e := group(g)
+		if e == nil {
+			e = os.Chown(p, -1, gid)
+		}
+		if e != nil {
+			l.Close()
+			return nil, e
+		}
+		mode = 0660
+	}
+	if e := os.Chmod(p, mode); e != nil {
+		l.Close()
+		return nil, e
+	}
+	return l, nil
+}
+
+// group returns the gid of the group named or numbered g.
+func group(g string) (int, error) {
+	if gid, e := strconv.Atoi(g); e == nil {
+		return gid, nil
+	}
+	grp, e := user.LookupGroup(g)
+	if e != nil {
+		return 0, err.New(UnknownGroup, g)
+	}
+	return strconv.Atoi(grp.Gid)
+}
+
+// RunSocket serves callers of the socket s, each one with the
+// permissions granted to its user and groups.
+func (c *Thread) RunSocket(l net.Listener, s *config.Socket) {
+	debug.Ver("Thread RunSocket()")
+
+	for {
+		conn, e := l.Accept()
+		if errors.Is(e, net.ErrClosed) == true {
+			return
+		} else if e != nil {
+			debug.Err("Thread socket connection failed %s", e.Error())
+			continue
+		}
+		uid, gids, e := peer(conn)
+		if e != nil {
+			debug.Warn("Thread socket %s", e.Error())
+			conn.Close()
+			continue
+		}
+		p := s.Permissions(uid, gids)
+		if len(p) == 0 {
+			debug.Warn("Thread socket denying uid %s", uid)
+			conn.Close()
+			continue
+		}
+		debug.Ver("Thread socket connection established with uid %s %v", uid, p)
+		ctx := module.WithPermissions(event.Background(), p)
+		go communication.NewConnection(ctx, conn).Serve(c.handle)
+	}
+}
+
+// peer returns the uid and the gids of the process connected with conn,
+// as the kernel recorded them when it connected. The groups of its user
+// in the group database do not count, the process might have dropped
+// them.
+func peer(conn net.Conn) (string, []string, error) {
+	u, ok := conn.(*net.UnixConn)
+	if ok == false {
+		return "", nil, err.New(NoCredentials, conn.RemoteAddr().String())
+	}
+	raw, e := u.SyscallConn()
+	if e != nil {
+		return "", nil, e
+	}
+	var cred *syscall.Ucred
+	var gids []string
+	var ce error
+	if e := raw.Control(func(fd uintptr) {
+		cred, ce = syscall.GetsockoptUcred(int(fd), syscall.SOL_SOCKET, syscall.SO_PEERCRED)
+		if ce == nil {
+			gids, ce = groups(int(fd))
+		}
+	}); e != nil {
+		return "", nil, e
+	}
+	if ce != nil {
+		return "", nil, err.New(NoCredentials, ce.Error())
+	}
+	uid := strconv.FormatUint(uint64(cred.Uid), 10)
+	gids = append([]string{strconv.FormatUint(uint64(cred.Gid), 10)}, gids...)
+	return uid, gids, nil
+}
+
+// soPeerGroups is SO_PEERGROUPS, missing in syscall
+const soPeerGroups = 59
+
+// groups returns the supplementary groups of the peer of the socket fd.
+// Kernels not knowing SO_PEERGROUPS report none, callers are then
+// authorized by their uid and gid only.
+func groups(fd int) ([]string, error) {
+	b := make([]uint32, 16)
+	for {
+		n := uint32(len(b) * 4)
+		_, _, errno := syscall.Syscall6(syscall.SYS_GETSOCKOPT, uintptr(fd), syscall.SOL_SOCKET, soPeerGroups,
+			uintptr(unsafe.Pointer(&b[0])), uintptr(unsafe.Pointer(&n)), 0)
+		switch errno {
+		case 0:
+			var gids []string
+			for _, g := range b[:n/4] {
+				gids = append(gids, strconv.FormatUint(uint64(g), 10))
+			}
+			return gids, nil
+		case syscall.ERANGE:
+			// n is the size needed
+			b = make([]uint32, n/4+1)
+		case syscall.ENOPROTOOPT:
+			return nil, nil
+		default:
+			return nil, errno
+		}
+	}
+}
@@ -0,0 +1,86 @@
+package server
+
+import (
+	"github.com/pfandl/dws/config"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"testing"
+)
+
+func TestListenSocket(t *testing.T) {
+	gid := strconv.Itoa(os.Getgid())
+	for _, tt := range []struct {
+		name  string
+		group string
+		mode  os.FileMode
+		fail  bool
+	}{
+		{name: "owner only", mode: 0600},
+		{name: "group", group: gid, mode: 0660},
+		{name: "unknown group", group: "no-such-group-here", fail: true},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			p := filepath.Join(t.TempDir(), "dws.sock")
+			c := &Thread{Server: &config.Server{Socket: &config.Socket{Path: p, Group: tt.group}}}
+			l, e := c.listenSocket()
+			if tt.fail == true {
+				if e == nil {
+					l.Close()
+					t.Fatal("listening succeeded")
+				}
+				return
+			}
+			if e != nil {
+				t.Fatal(e)
+			}
+			defer l.Close()
+			fi, e := os.Stat(p)
+			if e != nil {
+				t.Fatal(e)
+			}
+			if fi.Mode().Perm() != tt.mode {
+				t.Errorf("got mode %v, want %v", fi.Mode().Perm(), tt.mode)
+			}
+		})
+	}
+}
+
+func TestPeer(t *testing.T) {
+	g, e := os.Getgroups()
+	if e != nil {
+		t.Fatal(e)
+	}
+	want := []string{strconv.Itoa(os.Getgid())}
+	for _, i := range g {
+		want = append(want, strconv.Itoa(i))
+	}
+	l, e := net.Listen("unix", filepath.Join(t.TempDir(), "dws.sock"))
+	if e != nil {
+		t.Fatal(e)
+	}
+	defer l.Close()
+	c, e := net.Dial("unix", l.Addr().String())
+	if e != nil {
+		t.Fatal(e)
+	}
+	defer c.Close()
+	conn, e := l.Accept()
+	if e != nil {
+		t.Fatal(e)
+	}
+	defer conn.Close()
+
+	uid, gids, e := peer(conn)
+	if e != nil {
+		t.Fatal(e)
+	}
+	if uid != strconv.Itoa(os.Getuid()) {
+		t.Errorf("got uid %s, want %d", uid, os.Getuid())
+	}
+	if reflect.DeepEqual(gids, want) == false {
+		t.Errorf("got gids %v, want %v", gids, want)
+	}
+}
@@ -0,0 +1,188 @@
+// Package token keeps the api tokens callers authenticate with. A token
+// is a random secret handed out once, only its hash is stored.
+package token
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"github.com/pfandl/dws/debug"
+	"github.com/pfandl/dws/error"
+	"github.com/pfandl/dws/module"
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+)
+
+var (
+	// random bytes of a secret
+	SecretSize = 32
+	// errors
+	TokenMissing         = "token missing"
+	TokenInvalid         = "token invalid"
+	TokenExpired         = "token expired"
+	TokenNotFound        = "token not found"
+	TokenNeedsName       = "token needs a name"
+	TokenNeedsPermission = "token needs a permission"
+	TokenNameAlreadyUsed = "token name is already used"
+)
+
+// Token grants its bearer permissions until it expires.
+type Token struct {
+	Name string
+	// of the secret, left out when listed
+	Hash        string `json:",omitempty"`
+	Permissions []module.Permission
+	Created     time.Time
+	// zero if the token does not expire
+	Expires time.Time
+}
+
+// Created is a new token with its secret. It is not printed
+// with its secret, the secret is not to end up in logs.
+type Created struct {
+	Name    string
+	Token   string
+	Expires time.Time
+}
+
+func (c Created) String() string {
+	return c.Name
+}
+
+// Store keeps the tokens in the file at Path.
+type Store struct {
+	Path   string
+	lock   sync.Mutex
+	tokens []Token
+}
+
+// Open returns the store of the file at path, which is
+// created once the first token is.
+func Open(path string) (*Store, error) {
+	debug.Ver("Token: Open %s", path)
+	s := &Store{Path: path}
+	b, e := ioutil.ReadFile(path)
+	if os.IsNotExist(e) == true {
+		return s, nil
+	} else if e != nil {
+		return nil, e
+	}
+	if e := json.Unmarshal(b, &s.tokens); e != nil {
+		return nil, e
+	}
+	return s, nil
+}
+
+func hash(secret string) string {
+	h := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(h[:])
+}
+
+// save writes all tokens, readable by the owner only.
+func (s *Store) save() error {
+	b, e := json.MarshalIndent(s.tokens, "", "  ")
+	if e != nil {
+		return e
+	}
+	tmp := s.Path + ".tmp"
+	if e := ioutil.WriteFile(tmp, b, 0600); e != nil {
+		return e
+	}
+	return os.Rename(tmp, s.Path)
+}
+
+// Create adds the token name granting p and returns it with its
+// secret. A zero expires means the token does not expire.
+func (s *Store) Create(name string, p []module.Permission, expires time.Time) (Created, error) {
+	if name == "" {
+		return Created{}, err.New(TokenNeedsName)
+	}
+	if len(p) == 0 {
+		return Created{}, err.New(TokenNeedsPermission, name)
+	}
+	for _, q := range p {
+		if _, e := module.ParsePermission(string(q)); e != nil {
+			return Created{}, e
+		}
+	}
+	b := make([]byte, SecretSize)
+	if _, e := rand.Read(b); e != nil {
+		return Created{}, e
+	}
+	secret := hex.EncodeToString(b)
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for _, t := range s.tokens {
+		if t.Name == name {
+			return Created{}, err.New(TokenNameAlreadyUsed, name)
+		}
+	}
+	s.tokens = append(s.tokens, Token{
+		Name:        name,
+		Hash:        hash(secret),
+		Permissions: p,
+		Created:     time.Now(),
+		Expires:     expires,
+	})
+	if e := s.save(); e != nil {
+		s.tokens = s.tokens[:len(s.tokens)-1]
+		return Created{}, e
+	}
+	return Created{Name: name, Token: secret, Expires: expires}, nil
+}
+
+// Revoke removes the token name.
+func (s *Store) Revoke(name string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for i, t := range s.tokens {
+		if t.Name != name {
+			continue
+		}
+		old := s.tokens
+		s.tokens = append(append([]Token{}, old[:i]...), old[i+1:]...)
+		if e := s.save(); e != nil {
+			s.tokens = old
+			return e
+		}
+		return nil
+	}
+	return err.New(TokenNotFound, name)
+}
+
+// List returns all tokens without their hashes.
+func (s *Store) List() []Token {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	l := make([]Token, len(s.tokens))
+	for i, t := range s.tokens {
+		t.Hash = ""
+		l[i] = t
+	}
+	return l
+}
+
+// Authenticate returns the permissions granted by the secret.
+func (s *Store) Authenticate(secret string) ([]module.Permission, error) {
+	if secret == "" {
+		return nil, err.New(TokenMissing)
+	}
+	h := hash(secret)
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for _, t := range s.tokens {
+		if subtle.ConstantTimeCompare([]byte(t.Hash), []byte(h)) == 0 {
+			continue
+		}
+		if t.Expires.IsZero() == false && time.Now().After(t.Expires) {
+			return nil, err.New(TokenExpired, t.Name)
+		}
+		return t.Permissions, nil
+	}
+	return nil, err.New(TokenInvalid)
+}
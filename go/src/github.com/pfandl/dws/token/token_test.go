@@ -0,0 +1,111 @@
+package token
+
+import (
+	"github.com/pfandl/dws/module"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCreate(t *testing.T) {
+	s, e := Open(filepath.Join(t.TempDir(), "tokens"))
+	if e != nil {
+		t.Fatal(e)
+	}
+	tests := []struct {
+		name string
+		p    []module.Permission
+		err  string
+	}{
+		{"reader", []module.Permission{module.Read}, ""},
+		{"admin", []module.Permission{module.Read, module.Admin}, ""},
+		{"", []module.Permission{module.Read}, TokenNeedsName},
+		{"nothing", nil, TokenNeedsPermission},
+		{"root", []module.Permission{"root"}, module.UnknownPermission},
+		{"reader", []module.Permission{module.Write}, TokenNameAlreadyUsed},
+	}
+	for _, tt := range tests {
+		c, e := s.Create(tt.name, tt.p, time.Time{})
+		if tt.err != "" {
+			if e == nil || strings.HasPrefix(e.Error(), tt.err) == false {
+				t.Errorf("%q: got %v, want %s", tt.name, e, tt.err)
+			}
+			continue
+		}
+		if e != nil {
+			t.Errorf("%q: %v", tt.name, e)
+			continue
+		}
+		if len(c.Token) != 2*SecretSize || c.String() != tt.name {
+			t.Errorf("%q: got token %q printed as %q", tt.name, c.Token, c.String())
+		}
+	}
+
+	// only the hash of a secret is kept, readable by us only
+	fi, e := os.Stat(s.Path)
+	if e != nil {
+		t.Fatal(e)
+	}
+	if fi.Mode().Perm() != 0600 {
+		t.Errorf("got mode %v, want 0600", fi.Mode().Perm())
+	}
+	for _, tk := range s.List() {
+		if tk.Hash != "" {
+			t.Errorf("%s listed with its hash", tk.Name)
+		}
+	}
+}
+
+func TestAuthenticate(t *testing.T) {
+	p := filepath.Join(t.TempDir(), "tokens")
+	s, e := Open(p)
+	if e != nil {
+		t.Fatal(e)
+	}
+	read := []module.Permission{module.Read}
+	valid, _ := s.Create("valid", read, time.Now().Add(time.Hour))
+	forever, _ := s.Create("forever", read, time.Time{})
+	expired, _ := s.Create("expired", read, time.Now().Add(-time.Second))
+	revoked, _ := s.Create("revoked", read, time.Time{})
+	if e := s.Revoke("revoked"); e != nil {
+		t.Fatal(e)
+	}
+	if e := s.Revoke("revoked"); e == nil || strings.HasPrefix(e.Error(), TokenNotFound) == false {
+		t.Errorf("revoked twice: got %v", e)
+	}
+
+	// tokens survive reopening the store
+	reopened, e := Open(p)
+	if e != nil {
+		t.Fatal(e)
+	}
+	for _, st := range []*Store{s, reopened} {
+		tests := []struct {
+			name   string
+			secret string
+			err    string
+		}{
+			{"valid", valid.Token, ""},
+			{"forever", forever.Token, ""},
+			{"expired", expired.Token, TokenExpired},
+			{"revoked", revoked.Token, TokenInvalid},
+			{"hash", hash(valid.Token), TokenInvalid},
+			{"missing", "", TokenMissing},
+		}
+		for _, tt := range tests {
+			got, e := st.Authenticate(tt.secret)
+			if tt.err != "" {
+				if e == nil || strings.HasPrefix(e.Error(), tt.err) == false {
+					t.Errorf("%s: got %v, want %s", tt.name, e, tt.err)
+				}
+				continue
+			}
+			if e != nil || reflect.DeepEqual(got, read) == false {
+				t.Errorf("%s: got %v %v", tt.name, got, e)
+			}
+		}
+	}
+}